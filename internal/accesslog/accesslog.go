@@ -0,0 +1,83 @@
+package accesslog
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	defaultFormat     = "json"
+	defaultMaxSizeMB  = 100
+	defaultMaxBackups = 5
+)
+
+// Entry is everything an access log line can tell about a request
+type Entry struct {
+	Time            time.Time
+	RequestID       string
+	ClientIP        string
+	Method          string
+	Path            string
+	Query           string
+	Protocol        string
+	Host            string
+	Status          int
+	BytesIn         int64
+	BytesOut        int64
+	UserAgent       string
+	Referer         string
+	Route           string
+	Upstream        string        // empty when the request was not proxied
+	UpstreamLatency time.Duration // time until the upstream sent its response headers
+	Duration        time.Duration // time until the response was written to the client
+}
+
+// Logger writes one line per entry in its format
+type Logger struct {
+	format Formatter
+	mu     sync.Mutex
+	out    io.Writer
+	buf    []byte
+}
+
+// New creates a logger for the config, writing to stdout unless a path is set
+func New(cfg schema.AccessLog) (*Logger, error) {
+	var format Formatter
+	switch f := ptr.Deref(cfg.Format, defaultFormat); f {
+	case "json":
+		format = JSON
+	case "combined":
+		format = Combined
+	case "template":
+		t, err := ParseTemplate(ptr.Deref(cfg.Template, ""))
+		if err != nil {
+			return nil, err
+		}
+		format = t
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", f)
+	}
+	var out io.Writer = os.Stdout
+	if cfg.Path != nil {
+		file, err := OpenFile(*cfg.Path, int64(ptr.Deref(cfg.MaxSizeMB, defaultMaxSizeMB))<<20, ptr.Deref(cfg.MaxBackups, defaultMaxBackups))
+		if err != nil {
+			return nil, err
+		}
+		out = file
+	}
+	return &Logger{format: format, out: out}, nil
+}
+
+// Log writes the entry, errors are dropped since there is nowhere left to report them
+func (l *Logger) Log(e *Entry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf = append(l.format(l.buf[:0], e), '\n')
+	l.out.Write(l.buf)
+}
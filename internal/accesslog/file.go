@@ -0,0 +1,138 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// files are the open log files by path. Reloading the config reuses them, so that loggers of the old and
+// the new config never write to the same file through different handles.
+var (
+	filesMu sync.Mutex
+	files   = make(map[string]*RotatingFile)
+)
+
+// openFile is swapped out by tests to make opening fail
+var openFile = os.OpenFile
+
+// RotatingFile is a log file that is rotated once it grows past its maximum size. The rotated files are
+// kept as path.1 (the newest) up to path.N (the oldest).
+type RotatingFile struct {
+	path string
+
+	mu         sync.Mutex
+	file       *os.File
+	size       int64
+	maxSize    int64
+	maxBackups int
+	// reopen is set when the new file of a rotation could not be opened, every write tries again
+	reopen bool
+	closed bool
+}
+
+// OpenFile opens the log file at the path, or returns the one that is already open with updated limits
+func OpenFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve access log path: %w", err)
+	}
+	filesMu.Lock()
+	defer filesMu.Unlock()
+	if f, ok := files[path]; ok {
+		f.mu.Lock()
+		f.maxSize, f.maxBackups = maxSize, maxBackups
+		f.mu.Unlock()
+		return f, nil
+	}
+	f := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	files[path] = f
+	return f, nil
+}
+
+// CloseUnused closes the open log files that are not at one of the paths, which a reload left without a
+// logger. Lines that requests of the previous config still log to them are dropped.
+func CloseUnused(paths []string) {
+	keep := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		if abs, err := filepath.Abs(p); err == nil {
+			keep[abs] = true
+		}
+	}
+	filesMu.Lock()
+	defer filesMu.Unlock()
+	for path, f := range files {
+		if !keep[path] {
+			f.close()
+			delete(files, path)
+		}
+	}
+}
+
+func (f *RotatingFile) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.file.Close()
+	f.closed = true
+}
+
+func (f *RotatingFile) open() error {
+	file, err := openFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat access log: %w", err)
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	// Until the new file opens, lines keep going to the rotated one rather than nowhere
+	if f.reopen {
+		f.switchFile()
+	} else if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		f.rotate()
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate shifts every backup up by one, dropping the oldest, and starts a new file
+func (f *RotatingFile) rotate() {
+	if f.maxBackups == 0 {
+		os.Remove(f.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxBackups))
+		for i := f.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		os.Rename(f.path, f.path+".1")
+	}
+	f.switchFile()
+}
+
+// switchFile opens a new file at the path and closes the current one. The current file is kept when
+// the new one cannot be opened.
+func (f *RotatingFile) switchFile() {
+	old := f.file
+	if err := f.open(); err != nil {
+		f.reopen = true
+		return
+	}
+	f.reopen = false
+	old.Close()
+}
@@ -0,0 +1,105 @@
+package accesslog
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := OpenFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+	}
+
+	expected := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for name, want := range expected {
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", filepath.Base(name), err)
+		}
+		if string(got) != want {
+			t.Errorf("expected %s to hold %q, got %q", filepath.Base(name), want, got)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups to be kept")
+	}
+
+	t.Run("reopening shares the file", func(t *testing.T) {
+		again, err := OpenFile(path, 1<<20, 2)
+		if err != nil {
+			t.Fatalf("failed to open: %v", err)
+		}
+		if again != f {
+			t.Errorf("expected the open file to be reused")
+		}
+		again.Write([]byte("fifth\n"))
+		got, _ := os.ReadFile(path)
+		if !strings.HasSuffix(string(got), "fourth\nfifth\n") {
+			t.Errorf("expected the new limit to apply, got %q", got)
+		}
+	})
+
+	t.Run("files no logger uses are closed", func(t *testing.T) {
+		dir := t.TempDir()
+		kept, err := OpenFile(filepath.Join(dir, "kept.log"), 1<<20, 1)
+		if err != nil {
+			t.Fatalf("failed to open: %v", err)
+		}
+		unused, err := OpenFile(filepath.Join(dir, "unused.log"), 1<<20, 1)
+		if err != nil {
+			t.Fatalf("failed to open: %v", err)
+		}
+		CloseUnused([]string{filepath.Join(dir, "kept.log")})
+		if _, err := kept.Write([]byte("line\n")); err != nil {
+			t.Errorf("expected the kept file to stay open, got %v", err)
+		}
+		if _, err := unused.Write([]byte("line\n")); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("expected the unused file to be closed, got %v", err)
+		}
+		again, err := OpenFile(filepath.Join(dir, "unused.log"), 1<<20, 1)
+		if err != nil {
+			t.Fatalf("failed to open: %v", err)
+		}
+		if again == unused {
+			t.Errorf("expected a closed file to be opened anew")
+		}
+		CloseUnused(nil)
+	})
+
+	t.Run("a file that cannot be opened keeps the rotated one", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "access.log")
+		f, err := OpenFile(path, 10, 1)
+		if err != nil {
+			t.Fatalf("failed to open: %v", err)
+		}
+		f.Write([]byte("first\n"))
+		openFile = func(string, int, os.FileMode) (*os.File, error) { return nil, os.ErrPermission }
+		_, err = f.Write([]byte("second\n"))
+		openFile = os.OpenFile
+		if err != nil {
+			t.Fatalf("expected the line to go to the rotated file, got %v", err)
+		}
+		if _, err := f.Write([]byte("third\n")); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		for name, want := range map[string]string{path + ".1": "first\nsecond\n", path: "third\n"} {
+			if got, _ := os.ReadFile(name); string(got) != want {
+				t.Errorf("expected %s to hold %q, got %q", filepath.Base(name), want, got)
+			}
+		}
+	})
+}
@@ -0,0 +1,206 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formatter appends the line for the entry to the buffer, without a trailing newline
+type Formatter func(buf []byte, e *Entry) []byte
+
+// fields are the values a template can refer to, which are also the keys of the JSON format. Strings
+// are escaped like in the combined format, as most of them are up to the client.
+var fields = map[string]func(buf []byte, e *Entry) []byte{
+	"time":                func(b []byte, e *Entry) []byte { return e.Time.AppendFormat(b, time.RFC3339Nano) },
+	"request_id":          func(b []byte, e *Entry) []byte { return appendEscaped(b, e.RequestID) },
+	"client_ip":           func(b []byte, e *Entry) []byte { return appendEscaped(b, e.ClientIP) },
+	"method":              func(b []byte, e *Entry) []byte { return appendEscaped(b, e.Method) },
+	"path":                func(b []byte, e *Entry) []byte { return appendEscaped(b, e.Path) },
+	"query":               func(b []byte, e *Entry) []byte { return appendEscaped(b, e.Query) },
+	"protocol":            func(b []byte, e *Entry) []byte { return appendEscaped(b, e.Protocol) },
+	"host":                func(b []byte, e *Entry) []byte { return appendEscaped(b, e.Host) },
+	"status":              func(b []byte, e *Entry) []byte { return strconv.AppendInt(b, int64(e.Status), 10) },
+	"bytes_in":            func(b []byte, e *Entry) []byte { return strconv.AppendInt(b, e.BytesIn, 10) },
+	"bytes_out":           func(b []byte, e *Entry) []byte { return strconv.AppendInt(b, e.BytesOut, 10) },
+	"user_agent":          func(b []byte, e *Entry) []byte { return appendEscaped(b, e.UserAgent) },
+	"referer":             func(b []byte, e *Entry) []byte { return appendEscaped(b, e.Referer) },
+	"route":               func(b []byte, e *Entry) []byte { return appendEscaped(b, e.Route) },
+	"upstream":            func(b []byte, e *Entry) []byte { return appendEscaped(b, e.Upstream) },
+	"upstream_latency_ms": func(b []byte, e *Entry) []byte { return appendMillis(b, e.UpstreamLatency) },
+	"duration_ms":         func(b []byte, e *Entry) []byte { return appendMillis(b, e.Duration) },
+}
+
+// jsonEntry fixes the order and types of the JSON format
+type jsonEntry struct {
+	Time              string  `json:"time"`
+	RequestID         string  `json:"request_id,omitempty"`
+	ClientIP          string  `json:"client_ip"`
+	Method            string  `json:"method"`
+	Path              string  `json:"path"`
+	Query             string  `json:"query,omitempty"`
+	Protocol          string  `json:"protocol"`
+	Host              string  `json:"host"`
+	Status            int     `json:"status"`
+	BytesIn           int64   `json:"bytes_in"`
+	BytesOut          int64   `json:"bytes_out"`
+	UserAgent         string  `json:"user_agent,omitempty"`
+	Referer           string  `json:"referer,omitempty"`
+	Route             string  `json:"route,omitempty"`
+	Upstream          string  `json:"upstream,omitempty"`
+	UpstreamLatencyMs float64 `json:"upstream_latency_ms,omitempty"`
+	DurationMs        float64 `json:"duration_ms"`
+}
+
+// JSON writes the entry as a JSON object
+func JSON(buf []byte, e *Entry) []byte {
+	b, _ := json.Marshal(jsonEntry{
+		Time:              e.Time.Format(time.RFC3339Nano),
+		RequestID:         e.RequestID,
+		ClientIP:          e.ClientIP,
+		Method:            e.Method,
+		Path:              e.Path,
+		Query:             e.Query,
+		Protocol:          e.Protocol,
+		Host:              e.Host,
+		Status:            e.Status,
+		BytesIn:           e.BytesIn,
+		BytesOut:          e.BytesOut,
+		UserAgent:         e.UserAgent,
+		Referer:           e.Referer,
+		Route:             e.Route,
+		Upstream:          e.Upstream,
+		UpstreamLatencyMs: millis(e.UpstreamLatency),
+		DurationMs:        millis(e.Duration),
+	})
+	return append(buf, b...)
+}
+
+// Combined writes the entry in the Apache combined log format
+func Combined(buf []byte, e *Entry) []byte {
+	buf = append(buf, dash(e.ClientIP)...)
+	buf = append(buf, " - - ["...)
+	buf = e.Time.AppendFormat(buf, "02/Jan/2006:15:04:05 -0700")
+	buf = append(buf, "] \""...)
+	buf = appendEscaped(buf, e.Method)
+	buf = append(buf, ' ')
+	buf = appendEscaped(buf, e.Path)
+	if e.Query != "" {
+		buf = append(buf, '?')
+		buf = appendEscaped(buf, e.Query)
+	}
+	buf = append(buf, ' ')
+	buf = append(buf, e.Protocol...)
+	buf = append(buf, "\" "...)
+	buf = strconv.AppendInt(buf, int64(e.Status), 10)
+	buf = append(buf, ' ')
+	if e.BytesOut == 0 {
+		buf = append(buf, '-')
+	} else {
+		buf = strconv.AppendInt(buf, e.BytesOut, 10)
+	}
+	buf = append(buf, " \""...)
+	buf = appendEscaped(buf, dash(e.Referer))
+	buf = append(buf, "\" \""...)
+	buf = appendEscaped(buf, dash(e.UserAgent))
+	return append(buf, '"')
+}
+
+// ParseTemplate compiles a template like "${method} ${path} ${status}" into a formatter. Every field of
+// the JSON format can be used as a variable, either as $name or ${name}, and $$ is a literal $.
+func ParseTemplate(template string) (Formatter, error) {
+	if template == "" {
+		return nil, fmt.Errorf("access log template cannot be empty")
+	}
+	// The template is split into literals and fields once, so that formatting does not have to parse it
+	type part struct {
+		literal string
+		field   func([]byte, *Entry) []byte
+	}
+	var parts []part
+	var literal strings.Builder
+	for i := 0; i < len(template); i++ {
+		if template[i] != '$' || i+1 == len(template) {
+			literal.WriteByte(template[i])
+			continue
+		}
+		var name string
+		switch rest := template[i+1:]; {
+		case rest[0] == '$':
+			literal.WriteByte('$')
+			i++
+			continue
+		case rest[0] == '{':
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated variable in access log template %q", template)
+			}
+			name = rest[1:end]
+			i += end + 1
+		default:
+			end := strings.IndexFunc(rest, func(r rune) bool {
+				return !(r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9'))
+			})
+			if end < 0 {
+				end = len(rest)
+			}
+			name = rest[:end]
+			i += end
+		}
+		field, ok := fields[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown access log field %q", name)
+		}
+		if literal.Len() > 0 {
+			parts = append(parts, part{literal: literal.String()})
+			literal.Reset()
+		}
+		parts = append(parts, part{field: field})
+	}
+	if literal.Len() > 0 {
+		parts = append(parts, part{literal: literal.String()})
+	}
+	return func(buf []byte, e *Entry) []byte {
+		for _, p := range parts {
+			if p.field != nil {
+				buf = p.field(buf, e)
+			} else {
+				buf = append(buf, p.literal...)
+			}
+		}
+		return buf
+	}, nil
+}
+
+// appendEscaped escapes quotes, backslashes and control characters like Apache does, so that a client
+// cannot break out of a quoted field or forge a line
+func appendEscaped(buf []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			buf = append(buf, '\\', c)
+		case c < 0x20 || c == 0x7f:
+			buf = append(buf, fmt.Sprintf("\\x%02x", c)...)
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return buf
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func appendMillis(buf []byte, d time.Duration) []byte {
+	return strconv.AppendFloat(buf, millis(d), 'f', 3, 64)
+}
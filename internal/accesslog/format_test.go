@@ -0,0 +1,102 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+var testEntry = &Entry{
+	Time:            time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+	RequestID:       "req-1",
+	ClientIP:        "203.0.113.9",
+	Method:          "POST",
+	Path:            "/pay",
+	Query:           "id=7",
+	Protocol:        "HTTP/1.1",
+	Host:            "shop.example.com",
+	Status:          201,
+	BytesIn:         12,
+	BytesOut:        345,
+	UserAgent:       `curl/8.0 "quoted"`,
+	Route:           "payments",
+	Upstream:        "10.0.0.1:80",
+	UpstreamLatency: 1500 * time.Microsecond,
+	Duration:        2 * time.Millisecond,
+}
+
+func TestJSON(t *testing.T) {
+	var got map[string]any
+	if err := json.Unmarshal(JSON(nil, testEntry), &got); err != nil {
+		t.Fatalf("expected valid JSON: %v", err)
+	}
+	expected := map[string]any{
+		"time":                "2024-03-01T12:30:00Z",
+		"request_id":          "req-1",
+		"status":              float64(201),
+		"bytes_in":            float64(12),
+		"bytes_out":           float64(345),
+		"route":               "payments",
+		"upstream":            "10.0.0.1:80",
+		"upstream_latency_ms": 1.5,
+		"duration_ms":         float64(2),
+	}
+	for key, want := range expected {
+		if got[key] != want {
+			t.Errorf("expected %s to be %v, got %v", key, want, got[key])
+		}
+	}
+}
+
+func TestCombined(t *testing.T) {
+	expected := `203.0.113.9 - - [01/Mar/2024:12:30:00 +0000] "POST /pay?id=7 HTTP/1.1" 201 345 "-" "curl/8.0 \"quoted\""`
+	if got := string(Combined(nil, testEntry)); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestParseTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		expected string
+		err      bool
+	}{
+		{name: "braced and bare fields", template: "${method} $path -> $upstream in ${upstream_latency_ms}ms", expected: "POST /pay -> 10.0.0.1:80 in 1.500ms"},
+		{name: "escaped dollar", template: "$$${bytes_out}", expected: "$345"},
+		{name: "trailing literal", template: "[${route}]", expected: "[payments]"},
+		{name: "escaped client values", template: `"${user_agent}"`, expected: `"curl/8.0 \"quoted\""`},
+		{name: "unknown field", template: "${nope}", err: true},
+		{name: "unterminated field", template: "${status", err: true},
+		{name: "empty template", template: "", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := ParseTemplate(tt.template)
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			if got := string(format(nil, testEntry)); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseTemplateForgedLine(t *testing.T) {
+	format, err := ParseTemplate("${method} ${path}")
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	e := *testEntry
+	e.Path = "/\nGET /admin"
+	if got, expected := string(format(nil, &e)), `POST /\x0aGET /admin`; got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
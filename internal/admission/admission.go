@@ -0,0 +1,101 @@
+package admission
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/maxcelant/jap/internal/schema"
+)
+
+// FieldError is a single violation, at the path of the field it was found in, e.g.
+// app.sinks[1].upstreams[0].address. Fields are named as they are in the config file.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ErrorList holds every violation found in a config
+type ErrorList []FieldError
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, e := range l {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (l *ErrorList) add(field, format string, args ...any) {
+	*l = append(*l, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// appRef is an app of a config together with its path in the config
+type appRef struct {
+	path string
+	app  *schema.App
+}
+
+// Admit defaults and validates the config the proxy is started with. Every app is defaulted in place
+// and validated, the apps are checked against each other and the tracing config is validated. All
+// violations are returned together as an ErrorList.
+func Admit(cfg *schema.Config) error {
+	return admit(cfg, nil, nil)
+}
+
+// AdmitUpdate admits a config sent to the config API like Admit, also checking its apps against the
+// running apps they do not replace. The config API is not authenticated, so a direct response may only
+// use a bodyFile that the running apps already serve, which were set in the config file.
+func AdmitUpdate(cfg *schema.Config, running []schema.App) error {
+	bodyFiles := make(map[string]bool)
+	for _, app := range running {
+		for _, r := range app.Routes {
+			if r.DirectResponse != nil && r.DirectResponse.BodyFile != nil {
+				bodyFiles[*r.DirectResponse.BodyFile] = true
+			}
+		}
+	}
+	return admit(cfg, running, bodyFiles)
+}
+
+// admit restricts the body files of direct responses to bodyFiles, unless it is nil
+func admit(cfg *schema.Config, running []schema.App, bodyFiles map[string]bool) error {
+	var refs []appRef
+	posted := cfg.AllApps()
+	// Running apps come first, so that a conflict is reported at the path of the app that was sent
+	var others []appRef
+	for i := range running {
+		if !slices.ContainsFunc(posted, func(a schema.App) bool { return a.Name == running[i].Name }) {
+			others = append(others, appRef{fmt.Sprintf("running app %q", running[i].Name), &running[i]})
+		}
+	}
+	if len(posted) > len(cfg.Apps) {
+		refs = append(refs, appRef{"app", &cfg.App})
+	}
+	for i := range cfg.Apps {
+		refs = append(refs, appRef{fmt.Sprintf("apps[%d]", i), &cfg.Apps[i]})
+	}
+
+	var errs ErrorList
+	// A config with only tracing is fine, it leaves the apps that are running alone
+	if len(refs) == 0 && cfg.Tracing == nil {
+		errs.add("apps", "no apps configured")
+	}
+	for _, ref := range refs {
+		if err := Default(ref.app); err != nil {
+			errs.add(ref.path, "%v", err)
+			continue
+		}
+		validate(ref.path, ref.app, bodyFiles, &errs)
+	}
+	validateApps(append(others, refs...), &errs)
+	validateTracing(cfg.Tracing, &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
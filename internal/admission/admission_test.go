@@ -0,0 +1,230 @@
+package admission
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+func TestAdmit(t *testing.T) {
+	t.Run("defaults a valid config", func(t *testing.T) {
+		cfg := &schema.Config{Apps: []schema.App{{
+			Name:      "shop",
+			Listeners: []int{8080},
+			Routes:    []schema.Route{{Path: "/", Sink: "backend"}},
+			Sinks:     []schema.Sink{{Name: "backend", Upstreams: []schema.Upstream{{Address: "127.0.0.1", Port: 80}}}},
+		}}}
+		if err := Admit(cfg); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := ptr.Deref(cfg.Apps[0].Routes[0].Match, ""); got != "exact" {
+			t.Errorf("expected the match to be defaulted to exact, got %q", got)
+		}
+	})
+
+	t.Run("aggregates every violation with its field path", func(t *testing.T) {
+		cfg := &schema.Config{
+			App: schema.App{
+				Name:      "shop",
+				Listeners: []int{8080},
+				Routes:    []schema.Route{{Path: "/", Sink: "backend"}},
+				Sinks:     []schema.Sink{{Name: "backend", Upstreams: []schema.Upstream{{Address: "127.0.0.1", Port: 80}}}},
+			},
+			Apps: []schema.App{{
+				Name:      "shop",
+				Listeners: []int{8080},
+				Routes: []schema.Route{
+					{Path: "/", Sink: "backend"},
+					{Path: "orders", Sink: "missing", Methods: &[]string{"GET", "FETCH"}},
+				},
+				Sinks: []schema.Sink{
+					{Name: "backend", Upstreams: []schema.Upstream{{Address: "127.0.0.1", Port: 80}}},
+					{Name: "other", Strategy: ptr.To("fastest"), Upstreams: []schema.Upstream{{Address: "not-an-ip", Port: 80}}},
+				},
+			}},
+			Tracing: &schema.Tracing{Endpoint: "localhost:4318", SampleRatio: ptr.To(2.0)},
+		}
+		err := Admit(cfg)
+		var violations ErrorList
+		if !errors.As(err, &violations) {
+			t.Fatalf("expected an ErrorList, got %v", err)
+		}
+		expected := []string{
+			"apps[0].sinks[1].strategy",
+			"apps[0].sinks[1].upstreams[0].address",
+			"apps[0].routes[1].methods[1]",
+			"apps[0].routes[1].sink",
+			"apps[0].routes[1].path",
+			"apps[0].name",
+			"tracing.endpoint",
+			"tracing.sampleRatio",
+		}
+		if len(violations) != len(expected) {
+			t.Fatalf("expected %d violations, got %d: %v", len(expected), len(violations), violations)
+		}
+		for i, field := range expected {
+			if violations[i].Field != field {
+				t.Errorf("expected violation %d to be at %s, got %s (%s)", i, field, violations[i].Field, violations[i].Message)
+			}
+		}
+	})
+
+	t.Run("rejects a config without apps or tracing", func(t *testing.T) {
+		err := Admit(&schema.Config{})
+		var violations ErrorList
+		if !errors.As(err, &violations) || len(violations) != 1 || violations[0].Field != "apps" {
+			t.Errorf("expected a single violation at apps, got %v", err)
+		}
+	})
+
+	t.Run("accepts a config with only tracing", func(t *testing.T) {
+		if err := Admit(&schema.Config{Tracing: &schema.Tracing{Endpoint: "http://localhost:4318/v1/traces"}}); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("rejects an upstream listed twice in a sink", func(t *testing.T) {
+		cfg := &schema.Config{Apps: []schema.App{{
+			Name:      "shop",
+			Listeners: []int{8080},
+			Routes:    []schema.Route{{Path: "/", Sink: "backend"}},
+			Sinks: []schema.Sink{{Name: "backend", Strategy: ptr.To("least-request"), Upstreams: []schema.Upstream{
+				{Address: "127.0.0.1", Port: 80},
+				{Address: "127.0.0.1", Port: 81},
+				{Address: "127.0.0.1", Port: 80},
+			}}},
+		}}}
+		err := Admit(cfg)
+		var violations ErrorList
+		if !errors.As(err, &violations) || len(violations) != 1 || violations[0].Field != "apps[0].sinks[0].upstreams[2]" {
+			t.Errorf("expected a single violation at apps[0].sinks[0].upstreams[2], got %v", err)
+		}
+	})
+
+	t.Run("rejects a sink without upstreams", func(t *testing.T) {
+		cfg := &schema.Config{Apps: []schema.App{{
+			Name:      "shop",
+			Listeners: []int{8080},
+			Routes:    []schema.Route{{Path: "/", Sink: "backend"}},
+			Sinks:     []schema.Sink{{Name: "backend", Upstreams: []schema.Upstream{}}},
+		}}}
+		err := Admit(cfg)
+		var violations ErrorList
+		if !errors.As(err, &violations) || len(violations) != 1 || violations[0].Field != "apps[0].sinks[0].upstreams" {
+			t.Errorf("expected a single violation at apps[0].sinks[0].upstreams, got %v", err)
+		}
+	})
+
+	t.Run("rejects upstream weights below 1", func(t *testing.T) {
+		cfg := &schema.Config{Apps: []schema.App{{
+			Name:      "shop",
+			Listeners: []int{8080},
+			Routes:    []schema.Route{{Path: "/", Sink: "backend"}},
+			Sinks: []schema.Sink{{Name: "backend", Strategy: ptr.To("hash"), Upstreams: []schema.Upstream{
+				{Address: "127.0.0.1", Port: 80, Weight: ptr.To(0)},
+			}}},
+		}}}
+		err := Admit(cfg)
+		var violations ErrorList
+		if !errors.As(err, &violations) || len(violations) != 1 || violations[0].Field != "apps[0].sinks[0].upstreams[0].weight" {
+			t.Errorf("expected a single violation at apps[0].sinks[0].upstreams[0].weight, got %v", err)
+		}
+	})
+
+	t.Run("checks the apps against the running ones", func(t *testing.T) {
+		app := func(name string, hosts ...string) schema.App {
+			return schema.App{
+				Name:      name,
+				Hosts:     hosts,
+				Listeners: []int{8080},
+				Routes:    []schema.Route{{Path: "/", Sink: "backend"}},
+				Sinks:     []schema.Sink{{Name: "backend", Upstreams: []schema.Upstream{{Address: "127.0.0.1", Port: 80}}}},
+			}
+		}
+		running := []schema.App{app("shop", "shop.example.com"), app("fallback")}
+		tests := []struct {
+			name     string
+			cfg      *schema.Config
+			expected []string
+		}{
+			{"replacing a running app", &schema.Config{Apps: []schema.App{app("shop", "shop.example.com")}}, nil},
+			{"a host claimed twice", &schema.Config{Apps: []schema.App{app("blog", "blog.example.com", "SHOP.example.com.")}}, []string{"apps[0].hosts[1]"}},
+			{"two fallback apps on one listener", &schema.Config{App: app("admin")}, []string{"app.listeners[0]"}},
+			{"taking over a replaced host", &schema.Config{Apps: []schema.App{app("shop", "store.example.com"), app("blog", "shop.example.com")}}, nil},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				err := AdmitUpdate(tt.cfg, running)
+				var violations ErrorList
+				errors.As(err, &violations)
+				if len(violations) != len(tt.expected) {
+					t.Fatalf("expected violations at %v, got %v", tt.expected, err)
+				}
+				for i, field := range tt.expected {
+					if violations[i].Field != field {
+						t.Errorf("expected violation %d to be at %s, got %s (%s)", i, field, violations[i].Field, violations[i].Message)
+					}
+				}
+			})
+		}
+	})
+
+	t.Run("updates only use the body files of the running apps", func(t *testing.T) {
+		dir := t.TempDir()
+		served, secret := filepath.Join(dir, "maintenance.html"), filepath.Join(dir, "tls.key")
+		for _, name := range []string{served, secret} {
+			if err := os.WriteFile(name, []byte("body"), 0o600); err != nil {
+				t.Fatalf("failed to write %s: %v", name, err)
+			}
+		}
+		app := func(bodyFile string) schema.App {
+			return schema.App{
+				Name:      "shop",
+				Listeners: []int{8080},
+				Routes:    []schema.Route{{Path: "/", DirectResponse: &schema.DirectResponse{Status: 503, BodyFile: ptr.To(bodyFile)}}},
+			}
+		}
+		running := []schema.App{app(served)}
+		if err := AdmitUpdate(&schema.Config{App: app(served)}, running); err != nil {
+			t.Errorf("expected a body file of a running app to be admitted, got %v", err)
+		}
+		err := AdmitUpdate(&schema.Config{App: app(secret)}, running)
+		var violations ErrorList
+		if !errors.As(err, &violations) || len(violations) != 1 || violations[0].Field != "app.routes[0].directResponse.bodyFile" {
+			t.Errorf("expected a single violation at app.routes[0].directResponse.bodyFile, got %v", err)
+		}
+		if err := Admit(&schema.Config{App: app(secret)}); err != nil {
+			t.Errorf("expected the config file to use any body file, got %v", err)
+		}
+	})
+
+	t.Run("header operations", func(t *testing.T) {
+		cfg := &schema.Config{Apps: []schema.App{{
+			Name:      "shop",
+			Listeners: []int{8080},
+			Routes: []schema.Route{
+				{Path: "/", Sink: "backend", RequestHeaders: &schema.HeaderOps{Set: map[string]string{"authorization": "Bearer a$$b", "x-id": "$id"}}},
+				{Path: "/old", Redirect: &schema.Redirect{Path: ptr.To("/new")}, ResponseHeaders: &schema.HeaderOps{Remove: []string{"server"}}},
+			},
+			Sinks: []schema.Sink{{Name: "backend", Upstreams: []schema.Upstream{{Address: "127.0.0.1", Port: 80}}}},
+		}}}
+		err := Admit(cfg)
+		var violations ErrorList
+		if !errors.As(err, &violations) {
+			t.Fatalf("expected an ErrorList, got %v", err)
+		}
+		expected := []string{"apps[0].routes[1].responseHeaders", "apps[0].routes[0].requestHeaders.set[x-id]"}
+		if len(violations) != len(expected) {
+			t.Fatalf("expected %d violations, got %d: %v", len(expected), len(violations), violations)
+		}
+		for i, field := range expected {
+			if violations[i].Field != field {
+				t.Errorf("expected violation %d to be at %s, got %s (%s)", i, field, violations[i].Field, violations[i].Message)
+			}
+		}
+	})
+}
@@ -32,6 +32,11 @@ func (d *defaulter) setStrategy() error {
 		weighted bool
 	}
 	for i, s := range d.app.Sinks {
+		// A hash policy is only meaningful for the hash strategy
+		if s.Strategy == nil && s.Hash != nil {
+			d.app.Sinks[i].Strategy = ptr.To("hash")
+			continue
+		}
 		if s.Strategy == nil {
 			// Check if all upstreams have a weight set
 			allWeighted := len(s.Upstreams) > 0
@@ -91,6 +91,19 @@ func TestSetStrategy(t *testing.T) {
 			},
 			expectedStrategy: []string{"random"},
 		},
+		{
+			name: "hash policy sets strategy to hash",
+			sinks: []schema.Sink{
+				{
+					Name: "backend",
+					Hash: &schema.HashPolicy{Header: ptr.To("x-user-id")},
+					Upstreams: []schema.Upstream{
+						{Address: "127.0.0.1", Port: 8080, Weight: ptr.To(10)},
+					},
+				},
+			},
+			expectedStrategy: []string{"hash"},
+		},
 		{
 			name: "existing strategy is not overwritten",
 			sinks: []schema.Sink{
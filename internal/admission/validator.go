@@ -3,18 +3,36 @@ package admission
 import (
 	"fmt"
 	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 
+	"github.com/maxcelant/jap/internal/accesslog"
 	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
 )
 
+// validator records the violations of an app under its path in the config, e.g. app or apps[1]
 type validator struct {
-	app *schema.App
+	app  *schema.App
+	path string
+	errs *ErrorList
+	// bodyFiles are the only body files direct responses may use, any file may be used when it is nil
+	bodyFiles map[string]bool
 }
 
 var validStrategies = map[string]bool{
-	"round-robin": true,
-	"random":      true,
-	"weighted":    true,
+	"round-robin":          true,
+	"weighted-round-robin": true,
+	"random":               true,
+	"weighted":             true,
+	"least-request":        true,
+	"p2c":                  true,
+	"hash":                 true,
 }
 
 var validMatches = map[string]bool{
@@ -23,6 +41,12 @@ var validMatches = map[string]bool{
 	"regex":  true,
 }
 
+var validRetryConditions = map[string]bool{
+	"connect-failure": true,
+	"reset":           true,
+	"5xx":             true,
+}
+
 var validMethods = map[string]bool{
 	"GET":     true,
 	"POST":    true,
@@ -33,138 +57,746 @@ var validMethods = map[string]bool{
 	"OPTIONS": true,
 }
 
-// Validate ensures that all necessary fields are set and are correct
-func Validate(app *schema.App) error {
-	d := validator{app}
-	if err := d.validatePorts(); err != nil {
-		return fmt.Errorf("port validation failed: %w", err)
-	}
-	if err := d.validateStrategy(); err != nil {
-		return fmt.Errorf("sink strategy validation failed: %w", err)
-	}
-	if err := d.validatePrefix(); err != nil {
-		return fmt.Errorf("route prefix validation failed: %w", err)
-	}
-	// Add localhost and hostnames as a possibility here
-	if err := d.validateIP(); err != nil {
-		return fmt.Errorf("upstream IP validation failed: %w", err)
-	}
-	if err := d.validateMethods(); err != nil {
-		return fmt.Errorf("route methods validation failed: %w", err)
-	}
-	if err := d.validateListenerPorts(); err != nil {
-		return fmt.Errorf("listener ports validation failed: %w", err)
-	}
-	if err := d.validateRouteSinks(); err != nil {
-		return fmt.Errorf("route sink validation failed: %w", err)
-	}
-	if err := d.validateRoutePaths(); err != nil {
-		return fmt.Errorf("route path validation failed: %w", err)
+// Validate ensures that all necessary fields are set and are correct. Every violation is returned
+// together as an ErrorList, with fields under the path of the app in the config, e.g. app or apps[1].
+func Validate(path string, app *schema.App) error {
+	var errs ErrorList
+	validate(path, app, nil, &errs)
+	if len(errs) > 0 {
+		return errs
 	}
 	return nil
 }
 
-func (v validator) validatePorts() error {
-	for _, s := range v.app.Sinks {
-		for _, u := range s.Upstreams {
+func validate(path string, app *schema.App, bodyFiles map[string]bool, errs *ErrorList) {
+	v := validator{app, path, errs, bodyFiles}
+	v.validatePorts()
+	v.validateStrategy()
+	v.validatePrefix()
+	// Add localhost and hostnames as a possibility here
+	v.validateIP()
+	v.validateUpstreams()
+	v.validateMethods()
+	v.validateListenerPorts()
+	v.validateHosts()
+	v.validateRouteActions()
+	v.validateRoutePaths()
+	v.validateHeaderMatches()
+	v.validateValueMatches()
+	v.validateHealthChecks()
+	v.validateOutlierDetection()
+	v.validateCircuitBreakers()
+	v.validateRetries()
+	v.validateTimeouts()
+	v.validateRewrites()
+	v.validateFaults()
+	v.validateHeaderOps()
+	v.validateAccessLog()
+}
+
+func (v validator) sink(i int) string {
+	return fmt.Sprintf("%s.sinks[%d]", v.path, i)
+}
+
+func (v validator) route(i int) string {
+	return fmt.Sprintf("%s.routes[%d]", v.path, i)
+}
+
+func (v validator) validatePorts() {
+	for i, s := range v.app.Sinks {
+		for j, u := range s.Upstreams {
 			if u.Port < 0 || u.Port > 65535 {
-				return fmt.Errorf("invalid port value %d", u.Port)
+				v.errs.add(fmt.Sprintf("%s.upstreams[%d].port", v.sink(i), j), "invalid port value %d", u.Port)
 			}
 		}
 	}
-	return nil
 }
 
-func (v validator) validateStrategy() error {
-	for _, s := range v.app.Sinks {
+func (v validator) validateStrategy() {
+	for i, s := range v.app.Sinks {
+		field := v.sink(i) + ".strategy"
 		// This should never happen if you are running the defaulter first
 		if s.Strategy == nil || *s.Strategy == "" {
-			return fmt.Errorf("invalid strategy, value was null or blank")
+			v.errs.add(field, "invalid strategy, value was null or blank")
+			continue
 		}
 		if !validStrategies[*s.Strategy] {
-			return fmt.Errorf("invalid strategy %q", *s.Strategy)
+			v.errs.add(field, "invalid strategy %q", *s.Strategy)
+			continue
+		}
+		if s.Hash != nil && *s.Strategy != "hash" {
+			v.errs.add(v.sink(i)+".hash", "sink sets a hash policy but uses the %q strategy", *s.Strategy)
+		}
+		if *s.Strategy == "hash" && s.Hash != nil {
+			validateHashPolicy(v.sink(i)+".hash", *s.Hash, v.errs)
 		}
 	}
-	return nil
 }
 
-func (v validator) validatePrefix() error {
-	for _, r := range v.app.Routes {
+func validateHashPolicy(field string, h schema.HashPolicy, errs *ErrorList) {
+	set := 0
+	for _, key := range []struct {
+		name  string
+		value *string
+	}{{"header", h.Header}, {"cookie", h.Cookie}, {"queryParam", h.QueryParam}} {
+		if key.value == nil {
+			continue
+		}
+		if *key.value == "" {
+			errs.add(field+"."+key.name, "hash key name cannot be blank")
+		}
+		set++
+	}
+	if h.SourceIP {
+		set++
+	}
+	if set != 1 {
+		errs.add(field, "exactly one of header, cookie, queryParam or sourceIP must be set, found %d", set)
+	}
+}
+
+func (v validator) validatePrefix() {
+	for i, r := range v.app.Routes {
+		field := v.route(i) + ".match"
 		if r.Match == nil || *r.Match == "" {
-			return fmt.Errorf("invalid route match, value was null or blank")
+			v.errs.add(field, "invalid route match, value was null or blank")
+			continue
 		}
 		if !validMatches[*r.Match] {
-			return fmt.Errorf("invalid route path matcher %q", *r.Match)
+			v.errs.add(field, "invalid route path matcher %q", *r.Match)
 		}
 	}
-	return nil
 }
 
-func (v validator) validateIP() error {
-	for _, s := range v.app.Sinks {
-		for _, u := range s.Upstreams {
+func (v validator) validateIP() {
+	for i, s := range v.app.Sinks {
+		for j, u := range s.Upstreams {
+			field := fmt.Sprintf("%s.upstreams[%d].address", v.sink(i), j)
 			if u.Address == "" {
-				return fmt.Errorf("upstream address cannot be empty in sink %q", s.Name)
+				v.errs.add(field, "upstream address cannot be empty")
+				continue
 			}
 			if u.Address == "localhost" {
 				continue
 			}
 			// TODO: Validate hostnames as well
 			if ip := net.ParseIP(u.Address); ip == nil {
-				return fmt.Errorf("invalid IP address %q in sink %q", u.Address, s.Name)
+				v.errs.add(field, "invalid IP address %q", u.Address)
 			}
 		}
 	}
-	return nil
 }
 
-func (v validator) validateMethods() error {
-	for _, r := range v.app.Routes {
+// validateUpstreams rejects a sink without upstreams and an upstream listed twice in a sink, they would
+// share a single endpoint while strategies count them as two. Weights have to be positive for the
+// weighted strategies.
+func (v validator) validateUpstreams() {
+	for i, s := range v.app.Sinks {
+		if len(s.Upstreams) == 0 {
+			v.errs.add(v.sink(i)+".upstreams", "sink %q has no upstreams", s.Name)
+			continue
+		}
+		seen := make(map[string]bool)
+		for j, u := range s.Upstreams {
+			if u.Weight != nil && *u.Weight < 1 {
+				v.errs.add(fmt.Sprintf("%s.upstreams[%d].weight", v.sink(i), j), "upstream weight must be at least 1, got %d", *u.Weight)
+			}
+			addr := fmt.Sprintf("%s:%d", u.Address, u.Port)
+			if seen[addr] {
+				v.errs.add(fmt.Sprintf("%s.upstreams[%d]", v.sink(i), j), "upstream %s is listed more than once", addr)
+			}
+			seen[addr] = true
+		}
+	}
+}
+
+func (v validator) validateMethods() {
+	for i, r := range v.app.Routes {
 		if r.Methods == nil {
 			continue
 		}
-		for _, m := range *r.Methods {
+		for j, m := range *r.Methods {
 			if !validMethods[m] {
-				return fmt.Errorf("invalid HTTP method %q in route %q", m, r.Path)
+				v.errs.add(fmt.Sprintf("%s.methods[%d]", v.route(i), j), "invalid HTTP method %q", m)
 			}
 		}
 	}
-	return nil
 }
 
-func (v validator) validateListenerPorts() error {
-	for _, port := range v.app.Listeners {
+func (v validator) validateListenerPorts() {
+	for i, port := range v.app.Listeners {
 		if port < 1 || port > 65535 {
-			return fmt.Errorf("invalid listener port %d", port)
+			v.errs.add(fmt.Sprintf("%s.listeners[%d]", v.path, i), "invalid listener port %d", port)
 		}
 	}
-	return nil
 }
 
-func (v validator) validateRouteSinks() error {
+// hostPattern accepts a hostname, optionally with a leading "*." wildcard label
+var hostPattern = regexp.MustCompile(`^(\*\.)?([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+func (v validator) validateHosts() {
+	seen := make(map[string]bool)
+	for i, h := range v.app.Hosts {
+		field := fmt.Sprintf("%s.hosts[%d]", v.path, i)
+		host := strings.TrimSuffix(strings.ToLower(h), ".")
+		if !hostPattern.MatchString(host) {
+			v.errs.add(field, "invalid host %q, expected a hostname or a wildcard like *.example.com", h)
+			continue
+		}
+		if seen[host] {
+			v.errs.add(field, "host %q is listed more than once", h)
+		}
+		seen[host] = true
+	}
+}
+
+var validRedirectStatuses = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+func (v validator) validateRouteActions() {
 	sinkNames := make(map[string]bool)
 	for _, s := range v.app.Sinks {
 		sinkNames[s.Name] = true
 	}
-	for _, r := range v.app.Routes {
-		if r.Sink == "" {
-			return fmt.Errorf("route %q has no sink specified", r.Path)
+	for i, r := range v.app.Routes {
+		field := v.route(i)
+		set := 0
+		proxied := r.Sink != "" || len(r.Sinks) > 0
+		for _, cond := range []bool{r.Sink != "", len(r.Sinks) > 0, r.Redirect != nil, r.DirectResponse != nil} {
+			if cond {
+				set++
+			}
+		}
+		if set != 1 {
+			v.errs.add(field, "route must set exactly one of sink, sinks, redirect or directResponse")
+		}
+		if r.Sink != "" && !sinkNames[r.Sink] {
+			v.errs.add(field+".sink", "unknown sink %q", r.Sink)
+		}
+		validateSinkSplit(field, r, sinkNames, v.errs)
+		if !proxied && (r.Retries != nil || r.Rewrite != nil || r.Timeout != nil || r.IdleTimeout != nil || r.Mirror != nil) {
+			v.errs.add(field, "retries, rewrite, timeouts and mirror only apply to routes with a sink")
+		}
+		if !proxied && r.RequestHeaders != nil {
+			v.errs.add(field+".requestHeaders", "request headers only apply to routes with a sink")
+		}
+		if !proxied && r.ResponseHeaders != nil {
+			v.errs.add(field+".responseHeaders", "response headers only apply to routes with a sink, directResponse has its own headers")
+		}
+		if m := r.Mirror; m != nil {
+			if !sinkNames[m.Sink] {
+				v.errs.add(field+".mirror.sink", "unknown sink %q", m.Sink)
+			}
+			if m.Percent != nil && (*m.Percent < 0 || *m.Percent > 100) {
+				v.errs.add(field+".mirror.percent", "mirror percent must be between 0 and 100")
+			}
+			if m.BufferLimitBytes != nil && *m.BufferLimitBytes < 0 {
+				v.errs.add(field+".mirror.bufferLimitBytes", "mirror buffer limit cannot be negative")
+			}
+		}
+		if rd := r.Redirect; rd != nil {
+			if rd.Scheme != nil && *rd.Scheme != "http" && *rd.Scheme != "https" {
+				v.errs.add(field+".redirect.scheme", "invalid redirect scheme %q", *rd.Scheme)
+			}
+			if rd.Port != nil && (*rd.Port < 1 || *rd.Port > 65535) {
+				v.errs.add(field+".redirect.port", "invalid redirect port %d", *rd.Port)
+			}
+			if rd.Path != nil && !strings.HasPrefix(*rd.Path, "/") && !strings.HasPrefix(*rd.Path, "$") {
+				v.errs.add(field+".redirect.path", "redirect path %q must start with /", *rd.Path)
+			}
+			if rd.Status != nil && !validRedirectStatuses[*rd.Status] {
+				v.errs.add(field+".redirect.status", "invalid redirect status %d, expected 301, 302, 307 or 308", *rd.Status)
+			}
+		}
+		if dr := r.DirectResponse; dr != nil {
+			if dr.Status < 200 || dr.Status > 599 {
+				v.errs.add(field+".directResponse.status", "invalid direct response status %d", dr.Status)
+			}
+			if dr.Body != nil && dr.BodyFile != nil {
+				v.errs.add(field+".directResponse", "direct response can set only one of body or bodyFile")
+			}
+			if dr.BodyFile != nil {
+				// Other files are not even looked at, whether they exist is none of the sender's business
+				if v.bodyFiles != nil && !v.bodyFiles[*dr.BodyFile] {
+					v.errs.add(field+".directResponse.bodyFile", "body files can only be set in the config file, use body instead")
+				} else if _, err := os.Stat(*dr.BodyFile); err != nil {
+					v.errs.add(field+".directResponse.bodyFile", "invalid direct response body file: %v", err)
+				}
+			}
+		}
+	}
+}
+
+func validateSinkSplit(field string, r schema.Route, sinkNames map[string]bool, errs *ErrorList) {
+	if len(r.Sinks) == 0 {
+		if r.Sticky != nil {
+			errs.add(field+".sticky", "sticky is only allowed when splitting over sinks")
+		}
+		return
+	}
+	seen := make(map[string]bool)
+	total := 0
+	for i, ws := range r.Sinks {
+		sinkField := fmt.Sprintf("%s.sinks[%d]", field, i)
+		if !sinkNames[ws.Name] {
+			errs.add(sinkField+".name", "unknown sink %q", ws.Name)
 		}
-		if !sinkNames[r.Sink] {
-			return fmt.Errorf("route %q references unknown sink %q", r.Path, r.Sink)
+		if seen[ws.Name] {
+			errs.add(sinkField+".name", "sink %q is listed more than once", ws.Name)
 		}
+		seen[ws.Name] = true
+		if ws.Weight < 0 {
+			errs.add(sinkField+".weight", "weight cannot be negative")
+		}
+		total += max(ws.Weight, 0)
+	}
+	if total == 0 {
+		errs.add(field+".sinks", "at least one sink needs a positive weight")
+	}
+	if r.Sticky != nil {
+		validateHashPolicy(field+".sticky", *r.Sticky, errs)
 	}
-	return nil
 }
 
-func (v validator) validateRoutePaths() error {
-	for _, r := range v.app.Routes {
+func (v validator) validateRoutePaths() {
+	for i, r := range v.app.Routes {
+		field := v.route(i) + ".path"
 		if r.Path == "" {
-			return fmt.Errorf("route path cannot be empty")
+			v.errs.add(field, "route path cannot be empty")
+			continue
 		}
 		if r.Path[0] != '/' {
-			return fmt.Errorf("route path %q must start with /", r.Path)
+			v.errs.add(field, "route path %q must start with /", r.Path)
 		}
 	}
-	return nil
+}
+
+func (v validator) validateHealthChecks() {
+	for i, s := range v.app.Sinks {
+		hc := s.HealthCheck
+		if hc == nil {
+			continue
+		}
+		field := v.sink(i) + ".healthCheck"
+		if hc.Path == "" || hc.Path[0] != '/' {
+			v.errs.add(field+".path", "health check path %q must start with /", hc.Path)
+		}
+		if r := hc.ExpectedStatuses; r != nil && (r.Min < 100 || r.Max > 599 || r.Min > r.Max) {
+			v.errs.add(field+".expectedStatuses", "invalid expected status range %d-%d", r.Min, r.Max)
+		}
+		if hc.Interval != nil && *hc.Interval <= 0 {
+			v.errs.add(field+".interval", "health check interval must be positive")
+		}
+		if hc.Timeout != nil && *hc.Timeout <= 0 {
+			v.errs.add(field+".timeout", "health check timeout must be positive")
+		}
+		if hc.HealthyThreshold != nil && *hc.HealthyThreshold < 1 {
+			v.errs.add(field+".healthyThreshold", "health check healthy threshold must be at least 1")
+		}
+		if hc.UnhealthyThreshold != nil && *hc.UnhealthyThreshold < 1 {
+			v.errs.add(field+".unhealthyThreshold", "health check unhealthy threshold must be at least 1")
+		}
+	}
+}
+
+func (v validator) validateOutlierDetection() {
+	for i, s := range v.app.Sinks {
+		od := s.OutlierDetection
+		if od == nil {
+			continue
+		}
+		field := v.sink(i) + ".outlierDetection"
+		if od.ConsecutiveErrors != nil && *od.ConsecutiveErrors < 1 {
+			v.errs.add(field+".consecutiveErrors", "consecutive errors must be at least 1")
+		}
+		if od.BaseEjectionTime != nil && *od.BaseEjectionTime <= 0 {
+			v.errs.add(field+".baseEjectionTime", "base ejection time must be positive")
+		}
+		if od.MaxEjectionTime != nil && *od.MaxEjectionTime <= 0 {
+			v.errs.add(field+".maxEjectionTime", "max ejection time must be positive")
+		}
+		if od.BaseEjectionTime != nil && od.MaxEjectionTime != nil && *od.BaseEjectionTime > *od.MaxEjectionTime {
+			v.errs.add(field+".baseEjectionTime", "base ejection time cannot exceed the max ejection time")
+		}
+		if p := od.MaxEjectionPercent; p != nil && (*p < 0 || *p > 100) {
+			v.errs.add(field+".maxEjectionPercent", "max ejection percent %d must be between 0 and 100", *p)
+		}
+	}
+}
+
+func (v validator) validateRetries() {
+	for i, r := range v.app.Routes {
+		rp := r.Retries
+		if rp == nil {
+			continue
+		}
+		field := v.route(i) + ".retries"
+		if rp.Attempts != nil && *rp.Attempts < 1 {
+			v.errs.add(field+".attempts", "retry attempts must be at least 1")
+		}
+		for j, cond := range rp.RetryOn {
+			if validRetryConditions[cond] {
+				continue
+			}
+			if code, err := strconv.Atoi(cond); err != nil || code < 500 || code > 599 {
+				v.errs.add(fmt.Sprintf("%s.retryOn[%d]", field, j), "invalid retry condition %q", cond)
+			}
+		}
+		if rp.PerTryTimeout != nil && *rp.PerTryTimeout <= 0 {
+			v.errs.add(field+".perTryTimeout", "per try timeout must be positive")
+		}
+		if b := rp.Backoff; b != nil {
+			if b.BaseInterval != nil && *b.BaseInterval < 0 {
+				v.errs.add(field+".backoff.baseInterval", "retry backoff intervals cannot be negative")
+			}
+			if b.MaxInterval != nil && *b.MaxInterval < 0 {
+				v.errs.add(field+".backoff.maxInterval", "retry backoff intervals cannot be negative")
+			}
+			if b.BaseInterval != nil && b.MaxInterval != nil && *b.BaseInterval > *b.MaxInterval {
+				v.errs.add(field+".backoff.baseInterval", "retry backoff base interval cannot exceed the max interval")
+			}
+		}
+		if rp.BufferLimitBytes != nil && *rp.BufferLimitBytes < 0 {
+			v.errs.add(field+".bufferLimitBytes", "retry buffer limit cannot be negative")
+		}
+	}
+}
+
+func (v validator) validateTimeouts() {
+	for i, r := range v.app.Routes {
+		if r.Timeout != nil && *r.Timeout <= 0 {
+			v.errs.add(v.route(i)+".timeout", "timeout must be positive")
+		}
+		if r.IdleTimeout != nil && *r.IdleTimeout <= 0 {
+			v.errs.add(v.route(i)+".idleTimeout", "idle timeout must be positive")
+		}
+	}
+	if lt := v.app.ListenerTimeouts; lt != nil {
+		for _, t := range []struct {
+			name string
+			d    *schema.Duration
+		}{{"read", lt.Read}, {"readHeader", lt.ReadHeader}, {"write", lt.Write}, {"idle", lt.Idle}} {
+			if t.d != nil && *t.d < 0 {
+				v.errs.add(v.path+".listenerTimeouts."+t.name, "listener timeout cannot be negative")
+			}
+		}
+	}
+}
+
+func (v validator) validateCircuitBreakers() {
+	for i, s := range v.app.Sinks {
+		cb := s.CircuitBreaker
+		if cb == nil {
+			continue
+		}
+		field := v.sink(i) + ".circuitBreaker"
+		if cb.MaxRequests != nil && *cb.MaxRequests < 1 {
+			v.errs.add(field+".maxRequests", "max requests must be at least 1")
+		}
+		if cb.MaxPendingRequests != nil && *cb.MaxPendingRequests < 0 {
+			v.errs.add(field+".maxPendingRequests", "max pending requests cannot be negative")
+		}
+		if cb.MaxRetries != nil && *cb.MaxRetries < 0 {
+			v.errs.add(field+".maxRetries", "max retries cannot be negative")
+		}
+	}
+}
+
+func (v validator) validateHeaderMatches() {
+	for i, r := range v.app.Routes {
+		for j, h := range r.Headers {
+			validateHeaderMatch(fmt.Sprintf("%s.headers[%d]", v.route(i), j), h, v.errs)
+		}
+	}
+}
+
+func validateHeaderMatch(field string, h schema.HeaderMatch, errs *ErrorList) {
+	if h.Name == "" {
+		errs.add(field+".name", "header match name cannot be empty")
+	}
+	set := 0
+	for _, cond := range []bool{h.Exact != nil, h.Prefix != nil, h.Regex != nil, h.Present != nil} {
+		if cond {
+			set++
+		}
+	}
+	if set != 1 {
+		errs.add(field, "header match must set exactly one of exact, prefix, regex or present")
+	}
+	if h.Regex != nil {
+		if _, err := regexp.Compile(*h.Regex); err != nil {
+			errs.add(field+".regex", "invalid regex: %v", err)
+		}
+	}
+}
+
+var validHeaderVariables = map[string]bool{
+	"client_ip":  true,
+	"route":      true,
+	"upstream":   true,
+	"request_id": true,
+}
+
+func (v validator) validateHeaderOps() {
+	for i, s := range v.app.Sinks {
+		validateHeaderOps(v.sink(i)+".requestHeaders", s.RequestHeaders, v.errs)
+		validateHeaderOps(v.sink(i)+".responseHeaders", s.ResponseHeaders, v.errs)
+	}
+	names := make(map[string]bool)
+	for i, r := range v.app.Routes {
+		if r.Name != "" {
+			if names[r.Name] {
+				v.errs.add(v.route(i)+".name", "route name %q is used more than once", r.Name)
+			}
+			names[r.Name] = true
+		}
+		validateHeaderOps(v.route(i)+".requestHeaders", r.RequestHeaders, v.errs)
+		validateHeaderOps(v.route(i)+".responseHeaders", r.ResponseHeaders, v.errs)
+	}
+}
+
+func validateHeaderOps(field string, ops *schema.HeaderOps, errs *ErrorList) {
+	if ops == nil {
+		return
+	}
+	for i, name := range ops.Remove {
+		validateHeaderName(fmt.Sprintf("%s.remove[%d]", field, i), name, errs)
+	}
+	for _, group := range []struct {
+		op     string
+		values map[string]string
+	}{{"set", ops.Set}, {"add", ops.Add}} {
+		// Map order is random, sorting keeps the violations in a stable order
+		names := make([]string, 0, len(group.values))
+		for name := range group.values {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			valueField := fmt.Sprintf("%s.%s[%s]", field, group.op, name)
+			validateHeaderName(valueField, name, errs)
+			os.Expand(group.values[name], func(variable string) string {
+				// $$ stands for a literal $
+				if variable != "$" && !validHeaderVariables[variable] {
+					errs.add(valueField, "unknown variable %q", variable)
+				}
+				return ""
+			})
+		}
+	}
+}
+
+func validateHeaderName(field, name string, errs *ErrorList) {
+	if name == "" || strings.ContainsAny(name, " \t:\r\n") {
+		errs.add(field, "invalid header name %q", name)
+	}
+}
+
+func (v validator) validateAccessLog() {
+	if al := v.app.AccessLog; al != nil {
+		field := v.path + ".accessLog"
+		format := ptr.Deref(al.Format, "json")
+		switch format {
+		case "json", "combined":
+			if al.Template != nil {
+				v.errs.add(field+".template", "template is only used by the template format, got format %q", format)
+			}
+		case "template":
+			if _, err := accesslog.ParseTemplate(ptr.Deref(al.Template, "")); err != nil {
+				v.errs.add(field+".template", "%v", err)
+			}
+		default:
+			v.errs.add(field+".format", "invalid access log format %q, expected json, combined or template", format)
+		}
+		if al.Path != nil && *al.Path == "" {
+			v.errs.add(field+".path", "access log path cannot be empty, leave it out to log to stdout")
+		}
+		if al.MaxSizeMB != nil && *al.MaxSizeMB < 1 {
+			v.errs.add(field+".maxSizeMB", "access log max size must be at least 1MB")
+		}
+		if al.MaxBackups != nil && *al.MaxBackups < 0 {
+			v.errs.add(field+".maxBackups", "access log max backups cannot be negative")
+		}
+	}
+	for i, r := range v.app.Routes {
+		if r.AccessLog != nil && r.AccessLog.Percent != nil && (*r.AccessLog.Percent < 0 || *r.AccessLog.Percent > 100) {
+			v.errs.add(v.route(i)+".accessLog.percent", "access log percent must be between 0 and 100")
+		}
+	}
+}
+
+func (v validator) validateFaults() {
+	for i, r := range v.app.Routes {
+		f := r.Faults
+		if f == nil {
+			continue
+		}
+		field := v.route(i) + ".faults"
+		if f.Delay == nil && f.Abort == nil {
+			v.errs.add(field, "faults must set a delay or an abort")
+		}
+		if f.Header != nil {
+			validateHeaderMatch(field+".header", *f.Header, v.errs)
+		}
+		if d := f.Delay; d != nil {
+			if d.Percent != nil && (*d.Percent < 0 || *d.Percent > 100) {
+				v.errs.add(field+".delay.percent", "delay percent must be between 0 and 100")
+			}
+			if (d.Fixed != nil) == (d.Min != nil || d.Max != nil) {
+				v.errs.add(field+".delay", "delay must set either fixed or min and max")
+			} else if d.Fixed != nil && *d.Fixed <= 0 {
+				v.errs.add(field+".delay.fixed", "fixed delay must be positive")
+			} else if d.Fixed == nil && (d.Min == nil || d.Max == nil || *d.Min < 0 || *d.Max < *d.Min) {
+				v.errs.add(field+".delay", "delay needs a min that is not negative and a max of at least min")
+			}
+		}
+		if a := f.Abort; a != nil {
+			if a.Percent != nil && (*a.Percent < 0 || *a.Percent > 100) {
+				v.errs.add(field+".abort.percent", "abort percent must be between 0 and 100")
+			}
+			if (a.Status != nil) == a.Reset {
+				v.errs.add(field+".abort", "abort must set exactly one of status or reset")
+			}
+			if a.Status != nil && (*a.Status < 200 || *a.Status > 599) {
+				v.errs.add(field+".abort.status", "invalid abort status %d", *a.Status)
+			}
+		}
+	}
+}
+
+func (v validator) validateValueMatches() {
+	for i, r := range v.app.Routes {
+		for _, group := range []struct {
+			kind    string
+			field   string
+			matches []schema.ValueMatch
+		}{{"query parameter", "queryParams", r.QueryParams}, {"cookie", "cookies", r.Cookies}} {
+			kind := group.kind
+			for j, m := range group.matches {
+				field := fmt.Sprintf("%s.%s[%d]", v.route(i), group.field, j)
+				if m.Name == "" {
+					v.errs.add(field+".name", "%s match name cannot be empty", kind)
+				}
+				set := 0
+				for _, cond := range []bool{m.Exact != nil, m.Regex != nil, m.Present != nil} {
+					if cond {
+						set++
+					}
+				}
+				if set != 1 {
+					v.errs.add(field, "%s match must set exactly one of exact, regex or present", kind)
+				}
+				if m.Regex != nil {
+					if _, err := regexp.Compile(*m.Regex); err != nil {
+						v.errs.add(field+".regex", "invalid regex: %v", err)
+					}
+				}
+			}
+		}
+	}
+}
+
+func (v validator) validateRewrites() {
+	for i, r := range v.app.Routes {
+		rw := r.Rewrite
+		if rw == nil {
+			continue
+		}
+		field := v.route(i) + ".rewrite"
+		set := 0
+		for _, cond := range []bool{rw.StripPrefix != nil, rw.ReplacePrefix != nil, rw.RegexSubstitution != nil} {
+			if cond {
+				set++
+			}
+		}
+		if set > 1 {
+			v.errs.add(field, "rewrite can set only one of stripPrefix, replacePrefix or regexSubstitution")
+		}
+		match := ptr.Deref(r.Match, "exact")
+		if rw.StripPrefix != nil && !strings.HasPrefix(*rw.StripPrefix, "/") {
+			v.errs.add(field+".stripPrefix", "strip prefix %q must start with /", *rw.StripPrefix)
+		}
+		if rw.ReplacePrefix != nil {
+			if match != "prefix" {
+				v.errs.add(field+".replacePrefix", "replace prefix needs a prefix match, got %q", match)
+			}
+			if !strings.HasPrefix(*rw.ReplacePrefix, "/") {
+				v.errs.add(field+".replacePrefix", "replace prefix %q must start with /", *rw.ReplacePrefix)
+			}
+		}
+		if rw.RegexSubstitution != nil {
+			if match != "regex" {
+				v.errs.add(field+".regexSubstitution", "regex substitution needs a regex match, got %q", match)
+			} else if _, err := regexp.Compile(r.Path); err != nil {
+				v.errs.add(v.route(i)+".path", "invalid regex path %q: %v", r.Path, err)
+			}
+		}
+		if rw.Host != nil && (*rw.Host == "" || strings.ContainsAny(*rw.Host, "/ ")) {
+			v.errs.add(field+".host", "invalid host rewrite %q", *rw.Host)
+		}
+	}
+}
+
+// validateApps checks the apps against each other. Apps may share listeners, but only as long as every
+// host on a listener belongs to a single app and at most one app on it leaves its hosts empty.
+func validateApps(apps []appRef, errs *ErrorList) {
+	names := make(map[string]bool)
+	type claim struct {
+		port int
+		host string
+	}
+	claims := make(map[claim]string)
+	for _, ref := range apps {
+		app := ref.app
+		if app.Name == "" {
+			errs.add(ref.path+".name", "app names cannot be empty")
+		} else if names[app.Name] {
+			errs.add(ref.path+".name", "app %q is defined more than once", app.Name)
+			continue
+		}
+		names[app.Name] = true
+		hosts := app.Hosts
+		if len(hosts) == 0 {
+			hosts = []string{""} // the empty host stands for every host no other app claims
+		}
+		for i, port := range app.Listeners {
+			for j, h := range hosts {
+				c := claim{port, strings.TrimSuffix(strings.ToLower(h), ".")}
+				other, ok := claims[c]
+				if !ok {
+					claims[c] = app.Name
+					continue
+				}
+				if c.host == "" {
+					errs.add(fmt.Sprintf("%s.listeners[%d]", ref.path, i), "apps %q and %q both leave their hosts empty on listener %d", other, app.Name, port)
+				} else {
+					errs.add(fmt.Sprintf("%s.hosts[%d]", ref.path, j), "apps %q and %q both claim host %q on listener %d", other, app.Name, h, port)
+				}
+			}
+		}
+	}
+}
+
+// validateTracing checks the tracing config, which is shared by every app
+func validateTracing(t *schema.Tracing, errs *ErrorList) {
+	if t == nil {
+		return
+	}
+	endpoint, err := url.Parse(t.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		errs.add("tracing.endpoint", "tracing endpoint %q must be an http or https URL", t.Endpoint)
+	}
+	if t.ServiceName != nil && *t.ServiceName == "" {
+		errs.add("tracing.serviceName", "tracing service name cannot be empty")
+	}
+	if t.SampleRatio != nil && (*t.SampleRatio < 0 || *t.SampleRatio > 1) {
+		errs.add("tracing.sampleRatio", "tracing sample ratio must be between 0 and 1, got %v", *t.SampleRatio)
+	}
+	if t.FlushInterval != nil && *t.FlushInterval <= 0 {
+		errs.add("tracing.flushInterval", "tracing flush interval must be positive, got %s", *t.FlushInterval)
+	}
 }
@@ -21,7 +21,8 @@ This command loads the configuration from a config file (YAML or JSON),
 validates it, and starts both the worker server (port 8080) and the
 control server (port 8443). The worker server handles incoming HTTP
 requests and routes them to configured upstreams. The control server
-accepts live configuration updates via POST requests.
+serves the running configuration under /v1/config, where apps can be
+added, replaced and removed while the proxy runs.
 
 Use --path to specify a custom config file location. The proxy runs
 until interrupted (Ctrl+C), then gracefully shuts down.`,
@@ -46,7 +47,9 @@ func runStart(cmd *cobra.Command, args []string) {
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to load config")
 	}
-	log.Info().Int("routes", len(cfg.App.Routes)).Int("sinks", len(cfg.App.Sinks)).Msg("config loaded")
+	for _, app := range cfg.AllApps() {
+		log.Info().Str("app", app.Name).Strs("hosts", app.Hosts).Int("routes", len(app.Routes)).Int("sinks", len(app.Sinks)).Msg("config loaded")
+	}
 
 	if err := m.Start(cfg); err != nil {
 		log.Fatal().Err(err).Msg("failed to start server manager")
@@ -39,11 +39,8 @@ func Load(path string) (cfg *schema.Config, err error) {
 		return nil, fmt.Errorf("unsupported config file format: %s (expected .json, .yaml, or .yml)", ext)
 	}
 
-	if err := admission.Default(&cfg.App); err != nil {
-		return nil, fmt.Errorf("failed to default config object: %w", err)
-	}
-	if err := admission.Validate(&cfg.App); err != nil {
-		return nil, fmt.Errorf("failed to validate config object: %w", err)
+	if err := admission.Admit(cfg); err != nil {
+		return nil, fmt.Errorf("failed to admit config: %w", err)
 	}
 
 	return
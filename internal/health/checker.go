@@ -0,0 +1,180 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/maxcelant/jap/internal/routes"
+	"github.com/maxcelant/jap/internal/schema"
+	"github.com/rs/zerolog/log"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	defaultInterval           = 10 * time.Second
+	defaultTimeout            = 2 * time.Second
+	defaultHealthyThreshold   = 2
+	defaultUnhealthyThreshold = 3
+)
+
+// Checker actively probes the upstreams of every sink that has a health check configured, and marks
+// the matching endpoints healthy or unhealthy so that sinks take them in and out of rotation.
+type Checker struct {
+	ctx      context.Context
+	registry *routes.EndpointRegistry
+	client   *http.Client
+
+	mu     sync.Mutex
+	probes map[probeKey]*probe
+}
+
+type probeKey struct {
+	app, sink, addr string
+}
+
+type probe struct {
+	check    schema.HealthCheck
+	endpoint *routes.Endpoint
+	cancel   context.CancelFunc
+	// mu is held while the probe changes the health of its endpoint, so that once stop returns the
+	// probe cannot change it anymore
+	mu sync.Mutex
+}
+
+func (p *probe) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cancel()
+}
+
+// setHealthy changes the health of the endpoint unless the probe was stopped in the meantime
+func (p *probe) setHealthy(ctx context.Context, healthy bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ctx.Err() == nil {
+		p.endpoint.SetHealthy(healthy)
+	}
+}
+
+// NewChecker creates a checker whose probes run until the given context is cancelled
+func NewChecker(ctx context.Context, registry *routes.EndpointRegistry) *Checker {
+	return &Checker{
+		ctx:      ctx,
+		registry: registry,
+		client: &http.Client{
+			// A redirect is an answer from the upstream, it should be judged by its own status
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		probes: make(map[probeKey]*probe),
+	}
+}
+
+// Sync brings the running probes in line with the app. Probes of unchanged upstreams keep running
+// along with the health they have already established, probes of removed upstreams are stopped and
+// new or changed upstreams get a fresh probe.
+func (c *Checker) Sync(app schema.App) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wanted := make(map[probeKey]schema.HealthCheck)
+	var unchecked []probeKey
+	for _, s := range app.Sinks {
+		for _, u := range s.Upstreams {
+			k := probeKey{app.Name, s.Name, fmt.Sprintf("%s:%d", u.Address, u.Port)}
+			if s.HealthCheck == nil {
+				unchecked = append(unchecked, k)
+				continue
+			}
+			wanted[k] = *s.HealthCheck
+		}
+	}
+
+	for k, p := range c.probes {
+		check, ok := wanted[k]
+		if ok && reflect.DeepEqual(check, p.check) {
+			delete(wanted, k)
+			continue
+		}
+		if k.app == app.Name {
+			p.stop()
+			delete(c.probes, k)
+		}
+	}
+
+	// The check may have just been removed, in which case the upstream is trusted again. Its probe is
+	// stopped by now, so a check that was still running cannot mark it unhealthy afterwards.
+	for _, k := range unchecked {
+		c.registry.Get(k.app, k.sink, k.addr).SetHealthy(true)
+	}
+
+	for k, check := range wanted {
+		ctx, cancel := context.WithCancel(c.ctx)
+		p := &probe{
+			check:    check,
+			endpoint: c.registry.Get(k.app, k.sink, k.addr),
+			cancel:   cancel,
+		}
+		c.probes[k] = p
+		go c.run(ctx, k, p)
+	}
+}
+
+func (c *Checker) run(ctx context.Context, k probeKey, p *probe) {
+	interval := time.Duration(ptr.Deref(p.check.Interval, schema.Duration(defaultInterval)))
+	healthyThreshold := ptr.Deref(p.check.HealthyThreshold, defaultHealthyThreshold)
+	unhealthyThreshold := ptr.Deref(p.check.UnhealthyThreshold, defaultUnhealthyThreshold)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	passes, failures := 0, 0
+	for {
+		err := c.check(ctx, p.endpoint.Addr, p.check)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			passes, failures = passes+1, 0
+			if passes >= healthyThreshold && !p.endpoint.Healthy() {
+				log.Info().Str("app", k.app).Str("sink", k.sink).Str("upstream", k.addr).Msg("upstream is healthy again")
+				p.setHealthy(ctx, true)
+			}
+		} else {
+			passes, failures = 0, failures+1
+			if failures >= unhealthyThreshold && p.endpoint.Healthy() {
+				log.Warn().Err(err).Str("app", k.app).Str("sink", k.sink).Str("upstream", k.addr).Msg("upstream is unhealthy")
+				p.setHealthy(ctx, false)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check performs a single probe against the upstream
+func (c *Checker) check(ctx context.Context, addr string, check schema.HealthCheck) error {
+	timeout := time.Duration(ptr.Deref(check.Timeout, schema.Duration(defaultTimeout)))
+	expected := ptr.Deref(check.ExpectedStatuses, schema.StatusRange{Min: 200, Max: 299})
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+check.Path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create health check request: %w", err)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("health check request failed: %w", err)
+	}
+	res.Body.Close()
+	if res.StatusCode < expected.Min || res.StatusCode > expected.Max {
+		return fmt.Errorf("unexpected health check status %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package health
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maxcelant/jap/internal/routes"
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+// newUpstream starts a test server whose /healthz status can be flipped at runtime
+func newUpstream(t *testing.T) (schema.Upstream, *atomic.Int32) {
+	t.Helper()
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	t.Cleanup(srv.Close)
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return schema.Upstream{Address: host, Port: p}, &status
+}
+
+func waitFor(t *testing.T, desc string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", desc)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestChecker(t *testing.T) {
+	upstream, status := newUpstream(t)
+	addr := net.JoinHostPort(upstream.Address, strconv.Itoa(upstream.Port))
+	app := schema.App{
+		Name: "app",
+		Sinks: []schema.Sink{{
+			Name: "backend",
+			HealthCheck: &schema.HealthCheck{
+				Path:               "/healthz",
+				Interval:           ptr.To(schema.Duration(10 * time.Millisecond)),
+				HealthyThreshold:   ptr.To(1),
+				UnhealthyThreshold: ptr.To(2),
+			},
+			Upstreams: []schema.Upstream{upstream},
+		}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registry := routes.NewEndpointRegistry()
+	c := NewChecker(ctx, registry)
+	endpoint := registry.Get("app", "backend", addr)
+
+	c.Sync(app)
+	status.Store(http.StatusServiceUnavailable)
+	waitFor(t, "upstream to become unhealthy", func() bool { return !endpoint.Healthy() })
+
+	t.Run("health survives a reload with an unchanged upstream", func(t *testing.T) {
+		c.Sync(app)
+		if registry.Get("app", "backend", addr) != endpoint {
+			t.Fatalf("expected the endpoint to be reused across reloads")
+		}
+		if endpoint.Healthy() {
+			t.Errorf("expected the upstream to stay unhealthy after a reload")
+		}
+	})
+
+	t.Run("upstream is restored once it recovers", func(t *testing.T) {
+		status.Store(http.StatusOK)
+		waitFor(t, "upstream to become healthy", endpoint.Healthy)
+	})
+
+	t.Run("removing the health check trusts the upstream again", func(t *testing.T) {
+		status.Store(http.StatusServiceUnavailable)
+		waitFor(t, "upstream to become unhealthy", func() bool { return !endpoint.Healthy() })
+		unchecked := app
+		unchecked.Sinks = []schema.Sink{{Name: "backend", Upstreams: []schema.Upstream{upstream}}}
+		c.Sync(unchecked)
+		if !endpoint.Healthy() {
+			t.Errorf("expected the upstream to be healthy once its check was removed")
+		}
+		// The probe is gone, so the endpoint must stay healthy even though the upstream is failing
+		time.Sleep(50 * time.Millisecond)
+		if !endpoint.Healthy() {
+			t.Errorf("expected the stopped probe to leave the upstream alone")
+		}
+	})
+}
@@ -0,0 +1,324 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the upper bounds in seconds of the latency histograms, from 5ms up to 10s
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Default is the registry that the proxy records its metrics in
+var Default = &Registry{}
+
+// Registry holds a set of metrics and writes them in the Prometheus text exposition format
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// Counter creates and registers a counter with the given label names
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec: newVec[Counter](name, help, "counter", labels)}
+	r.register(c)
+	return c
+}
+
+// Gauge creates and registers a gauge with the given label names
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{vec: newVec[Gauge](name, help, "gauge", labels)}
+	r.register(g)
+	return g
+}
+
+// Histogram creates and registers a histogram with the given buckets and label names
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{vec: newVec[Histogram](name, help, "histogram", labels), buckets: buckets}
+	r.register(h)
+	return h
+}
+
+// WriteTo writes every metric in the text exposition format, sorted by name
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+	slices.SortFunc(metrics, func(a, b metric) int { return strings.Compare(a.name(), b.name()) })
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Handler serves the metrics to a Prometheus scraper
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// vec is a metric family, holding a series for every combination of label values
+type vec[S any] struct {
+	metricName, help, kind string
+	labels                 []string
+
+	mu     sync.RWMutex
+	series map[string]*labeled[S]
+}
+
+type labeled[S any] struct {
+	values []string
+	series *S
+}
+
+func newVec[S any](name, help, kind string, labels []string) vec[S] {
+	return vec[S]{metricName: name, help: help, kind: kind, labels: labels, series: make(map[string]*labeled[S])}
+}
+
+func (v *vec[S]) name() string { return v.metricName }
+
+// with returns the series for the label values, creating it on first use
+func (v *vec[S]) with(init func() *S, values ...string) *S {
+	if len(values) != len(v.labels) {
+		panic("metrics: " + v.metricName + " expects " + strconv.Itoa(len(v.labels)) + " label values")
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.RLock()
+	l, ok := v.series[key]
+	v.mu.RUnlock()
+	if ok {
+		return l.series
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if l, ok := v.series[key]; ok {
+		return l.series
+	}
+	l = &labeled[S]{values: slices.Clone(values), series: init()}
+	v.series[key] = l
+	return l.series
+}
+
+// each calls fn for every series in a stable order
+func (v *vec[S]) each(fn func(values []string, s *S)) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	v.mu.RUnlock()
+	slices.Sort(keys)
+	for _, k := range keys {
+		v.mu.RLock()
+		l, ok := v.series[k]
+		v.mu.RUnlock()
+		// The series may have been deleted since the keys were collected
+		if ok {
+			fn(l.values, l.series)
+		}
+	}
+}
+
+// DeleteFunc removes every series whose label values del returns true for. Holders of a deleted
+// series can keep using it, it is just no longer written.
+func (v *vec[S]) DeleteFunc(del func(values []string) bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for k, l := range v.series {
+		if del(l.values) {
+			delete(v.series, k)
+		}
+	}
+}
+
+func (v *vec[S]) writeHeader(w *bufio.Writer) {
+	w.WriteString("# HELP " + v.metricName + " " + strings.ReplaceAll(strings.ReplaceAll(v.help, `\`, `\\`), "\n", `\n`) + "\n")
+	w.WriteString("# TYPE " + v.metricName + " " + v.kind + "\n")
+}
+
+// writeSample writes a single line, extra is an additional label such as the le of a bucket
+func (v *vec[S]) writeSample(w *bufio.Writer, suffix string, values []string, extraName, extraValue string, value float64) {
+	w.WriteString(v.metricName + suffix)
+	if len(values) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, l := range v.labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l + `="` + escapeLabel(values[i]) + `"`)
+		}
+		if extraName != "" {
+			if len(values) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraName + `="` + extraValue + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+// CounterVec is a counter family
+type CounterVec struct {
+	vec[Counter]
+}
+
+// Counter only ever goes up
+type Counter struct {
+	bits atomic.Uint64
+}
+
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.with(func() *Counter { return &Counter{} }, values...)
+}
+
+func (c *Counter) Inc() { c.Add(1) }
+
+func (c *Counter) Add(delta float64) { addFloat(&c.bits, delta) }
+
+func (c *Counter) Value() float64 { return math.Float64frombits(c.bits.Load()) }
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.each(func(values []string, s *Counter) { c.writeSample(w, "", values, "", "", s.Value()) })
+}
+
+// GaugeVec is a gauge family
+type GaugeVec struct {
+	vec[Gauge]
+}
+
+// Gauge can go up and down
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+func (g *GaugeVec) With(values ...string) *Gauge {
+	return g.with(func() *Gauge { return &Gauge{} }, values...)
+}
+
+func (g *Gauge) Set(v float64) { g.bits.Store(math.Float64bits(v)) }
+
+func (g *Gauge) Inc() { g.Add(1) }
+
+func (g *Gauge) Dec() { g.Add(-1) }
+
+func (g *Gauge) Add(delta float64) { addFloat(&g.bits, delta) }
+
+func (g *Gauge) Value() float64 { return math.Float64frombits(g.bits.Load()) }
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	g.each(func(values []string, s *Gauge) { g.writeSample(w, "", values, "", "", s.Value()) })
+}
+
+// HistogramVec is a histogram family
+type HistogramVec struct {
+	vec[Histogram]
+	buckets []float64
+}
+
+// Histogram counts observations into buckets
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64 // counts[i] is the number of observations in (buckets[i-1], buckets[i]]
+	count   uint64
+	sum     float64
+}
+
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.with(func() *Histogram {
+		return &Histogram{buckets: h.buckets, counts: make([]uint64, len(h.buckets))}
+	}, values...)
+}
+
+func (h *Histogram) Observe(v float64) {
+	i, _ := slices.BinarySearch(h.buckets, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	h.each(func(values []string, s *Histogram) {
+		s.mu.Lock()
+		counts, count, sum := slices.Clone(s.counts), s.count, s.sum
+		s.mu.Unlock()
+		// Buckets are cumulative in the exposition format
+		var cumulative uint64
+		for i, le := range s.buckets {
+			cumulative += counts[i]
+			h.writeSample(w, "_bucket", values, "le", formatFloat(le), float64(cumulative))
+		}
+		h.writeSample(w, "_bucket", values, "le", "+Inf", float64(count))
+		h.writeSample(w, "_sum", values, "", "", sum)
+		h.writeSample(w, "_count", values, "", "", float64(count))
+	})
+}
+
+func addFloat(bits *atomic.Uint64, delta float64) {
+	for {
+		old := bits.Load()
+		if bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func escapeLabel(v string) string {
+	if !strings.ContainsAny(v, "\\\"\n") {
+		return v
+	}
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := &Registry{}
+	requests := r.Counter("test_requests_total", "Requests handled.", "route", "code")
+	inFlight := r.Gauge("test_in_flight", "Requests in flight.")
+	latency := r.Histogram("test_latency_seconds", "Request latency.", []float64{0.1, 1}, "route")
+
+	requests.With("orders", "200").Add(2)
+	requests.With(`say "hi"`, "500").Inc()
+	inFlight.With().Inc()
+	inFlight.With().Inc()
+	inFlight.With().Dec()
+	latency.With("orders").Observe(0.05)
+	latency.With("orders").Observe(0.1)
+	latency.With("orders").Observe(3)
+
+	var buf strings.Builder
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatalf("failed to write metrics: %v", err)
+	}
+	expected := `# HELP test_in_flight Requests in flight.
+# TYPE test_in_flight gauge
+test_in_flight 1
+# HELP test_latency_seconds Request latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{route="orders",le="0.1"} 2
+test_latency_seconds_bucket{route="orders",le="1"} 2
+test_latency_seconds_bucket{route="orders",le="+Inf"} 3
+test_latency_seconds_sum{route="orders"} 3.15
+test_latency_seconds_count{route="orders"} 3
+# HELP test_requests_total Requests handled.
+# TYPE test_requests_total counter
+test_requests_total{route="orders",code="200"} 2
+test_requests_total{route="say \"hi\"",code="500"} 1
+`
+	if buf.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, buf.String())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := &Registry{}
+	r.Counter("test_total", "Things.").With().Inc()
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("expected the text exposition content type, got %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "test_total 1\n") {
+		t.Errorf("expected the counter in the body, got %q", rec.Body.String())
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	r := &Registry{}
+	c := r.Counter("test_total", "Things.", "worker")
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				c.With("a").Inc()
+			}
+		}()
+	}
+	wg.Wait()
+	if got := c.With("a").Value(); got != 8000 {
+		t.Errorf("expected 8000, got %v", got)
+	}
+}
+
+func TestDeleteFunc(t *testing.T) {
+	r := &Registry{}
+	c := r.Counter("test_total", "Things.", "route")
+	c.With("orders").Inc()
+	old := c.With("legacy")
+	old.Inc()
+	c.DeleteFunc(func(values []string) bool { return values[0] == "legacy" })
+	old.Inc()
+
+	var buf strings.Builder
+	r.WriteTo(&buf)
+	if strings.Contains(buf.String(), "legacy") {
+		t.Errorf("expected the deleted series to be left out, got\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), `test_total{route="orders"} 1`) {
+		t.Errorf("expected the other series to be kept, got\n%s", buf.String())
+	}
+	if got := c.With("legacy").Value(); got != 0 {
+		t.Errorf("expected a deleted series to start over, got %v", got)
+	}
+}
+
+func TestWrongLabelCount(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for a missing label value")
+		}
+	}()
+	(&Registry{}).Counter("test_total", "Things.", "a", "b").With("a")
+}
@@ -0,0 +1,138 @@
+package routes
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+// RedirectHandler answers every request with a redirect to the request URL with some of its parts replaced
+type RedirectHandler struct {
+	Scheme     string // empty keeps the request scheme
+	Host       string // empty keeps the request host
+	Port       int    // zero keeps the request port
+	Path       string // empty keeps the request path
+	StripQuery bool
+	Status     int
+	// Pattern is the path of a regex route, the path template can refer to its capture groups
+	Pattern *regexp.Regexp
+}
+
+func compileRedirect(rd schema.Redirect, pattern *regexp.Regexp) RedirectHandler {
+	return RedirectHandler{
+		Scheme:     ptr.Deref(rd.Scheme, ""),
+		Host:       ptr.Deref(rd.Host, ""),
+		Port:       ptr.Deref(rd.Port, 0),
+		Path:       ptr.Deref(rd.Path, ""),
+		StripQuery: rd.StripQuery,
+		Status:     ptr.Deref(rd.Status, http.StatusMovedPermanently),
+		Pattern:    pattern,
+	}
+}
+
+func (h RedirectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := url.URL{
+		Scheme:   h.Scheme,
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		RawQuery: r.URL.RawQuery,
+	}
+	if target.Scheme == "" {
+		target.Scheme = "http"
+		if r.TLS != nil {
+			target.Scheme = "https"
+		}
+	}
+	if h.Host != "" || h.Port != 0 {
+		host, port, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host, port = r.Host, ""
+		}
+		if h.Host != "" {
+			host = h.Host
+		}
+		if h.Port != 0 {
+			port = strconv.Itoa(h.Port)
+		}
+		target.Host = host
+		if port != "" {
+			target.Host = net.JoinHostPort(host, port)
+		}
+	}
+	if h.Path != "" {
+		target.Path = h.expandPath(r.URL.Path)
+	}
+	if h.StripQuery {
+		target.RawQuery = ""
+	}
+	http.Redirect(w, r, target.String(), h.Status)
+}
+
+// expandPath fills in the path template. ${path} is the request path, and $1 or ${name} are the capture
+// groups of a regex route.
+func (h RedirectHandler) expandPath(path string) string {
+	var groups []string
+	if h.Pattern != nil {
+		groups = h.Pattern.FindStringSubmatch(path)
+	}
+	return os.Expand(h.Path, func(name string) string {
+		if h.Pattern != nil && groups != nil {
+			if i, err := strconv.Atoi(name); err == nil && i < len(groups) {
+				return groups[i]
+			}
+			if i := h.Pattern.SubexpIndex(name); i >= 0 {
+				return groups[i]
+			}
+		}
+		if name == "path" {
+			return path
+		}
+		return ""
+	})
+}
+
+// DirectResponseHandler answers every request with the same response
+type DirectResponseHandler struct {
+	Status  int
+	Headers http.Header
+	Body    []byte
+}
+
+func compileDirectResponse(dr schema.DirectResponse) (DirectResponseHandler, error) {
+	h := DirectResponseHandler{Status: dr.Status, Headers: make(http.Header, len(dr.Headers))}
+	for name, value := range dr.Headers {
+		h.Headers.Set(name, value)
+	}
+	switch {
+	case dr.Body != nil:
+		h.Body = []byte(*dr.Body)
+	case dr.BodyFile != nil:
+		body, err := os.ReadFile(*dr.BodyFile)
+		if err != nil {
+			return h, fmt.Errorf("failed to read body file: %w", err)
+		}
+		h.Body = body
+	}
+	return h, nil
+}
+
+func (h DirectResponseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for name, values := range h.Headers {
+		w.Header()[name] = values
+	}
+	if len(h.Body) > 0 && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", http.DetectContentType(h.Body))
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(h.Body)))
+	w.WriteHeader(h.Status)
+	if r.Method != http.MethodHead {
+		w.Write(h.Body)
+	}
+}
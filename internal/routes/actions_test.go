@@ -0,0 +1,126 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		redirect schema.Redirect
+		pattern  *regexp.Regexp
+		url      string
+		status   int
+		location string
+	}{
+		{
+			name:     "http to https",
+			redirect: schema.Redirect{Scheme: ptr.To("https")},
+			url:      "http://shop.example.com/cart?id=1",
+			status:   http.StatusMovedPermanently,
+			location: "https://shop.example.com/cart?id=1",
+		},
+		{
+			name:     "port is replaced and query stripped",
+			redirect: schema.Redirect{Scheme: ptr.To("https"), Port: ptr.To(8443), StripQuery: true, Status: ptr.To(308)},
+			url:      "http://shop.example.com:8080/cart?id=1",
+			status:   http.StatusPermanentRedirect,
+			location: "https://shop.example.com:8443/cart",
+		},
+		{
+			name:     "host and templated path",
+			redirect: schema.Redirect{Host: ptr.To("new.example.com"), Path: ptr.To("/v2${path}"), Status: ptr.To(302)},
+			url:      "http://old.example.com/users",
+			status:   http.StatusFound,
+			location: "http://new.example.com/v2/users",
+		},
+		{
+			name:     "capture groups of a regex route",
+			redirect: schema.Redirect{Path: ptr.To("/orders/${order}/user/$1")},
+			pattern:  regexp.MustCompile(`^/users/([0-9]+)/orders/(?P<order>[0-9]+)$`),
+			url:      "http://shop.example.com/users/12/orders/34",
+			status:   http.StatusMovedPermanently,
+			location: "http://shop.example.com/orders/34/user/12",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			compileRedirect(tt.redirect, tt.pattern).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if rec.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, rec.Code)
+			}
+			if got := rec.Header().Get("Location"); got != tt.location {
+				t.Errorf("expected location %q, got %q", tt.location, got)
+			}
+		})
+	}
+}
+
+func TestDirectResponseHandler(t *testing.T) {
+	bodyFile := filepath.Join(t.TempDir(), "deprecated.json")
+	if err := os.WriteFile(bodyFile, []byte(`{"error":"v1 is gone"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		response    schema.DirectResponse
+		status      int
+		body        string
+		contentType string
+	}{
+		{
+			name:        "inline body",
+			response:    schema.DirectResponse{Status: 200, Body: ptr.To("ok")},
+			status:      http.StatusOK,
+			body:        "ok",
+			contentType: "text/plain; charset=utf-8",
+		},
+		{
+			name:        "body file and headers",
+			response:    schema.DirectResponse{Status: 410, BodyFile: ptr.To(bodyFile), Headers: map[string]string{"content-type": "application/json"}},
+			status:      http.StatusGone,
+			body:        `{"error":"v1 is gone"}`,
+			contentType: "application/json",
+		},
+		{
+			name:     "no body",
+			response: schema.DirectResponse{Status: 204},
+			status:   http.StatusNoContent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := compileDirectResponse(tt.response)
+			if err != nil {
+				t.Fatalf("failed to compile: %v", err)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, rec.Code)
+			}
+			if rec.Body.String() != tt.body {
+				t.Errorf("expected body %q, got %q", tt.body, rec.Body.String())
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("expected content type %q, got %q", tt.contentType, got)
+			}
+		})
+	}
+
+	t.Run("missing body file", func(t *testing.T) {
+		if _, err := compileDirectResponse(schema.DirectResponse{Status: 200, BodyFile: ptr.To(filepath.Join(t.TempDir(), "missing"))}); err == nil {
+			t.Errorf("expected an error for the missing body file")
+		}
+	})
+}
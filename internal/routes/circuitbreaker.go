@@ -0,0 +1,122 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	defaultMaxRequests        = 1024
+	defaultMaxPendingRequests = 1024
+	defaultMaxRetries         = 3
+)
+
+// overloadedHeader is set on the responses of requests that a circuit breaker turned away
+const overloadedHeader = "X-Jap-Overloaded"
+
+// CircuitBreaker limits the concurrent requests and retries a sink receives. Once every request slot is
+// taken, new requests wait in a bounded queue, and once that queue is full they are failed right away.
+// A nil CircuitBreaker lets everything through. A sink keeps its breaker across config reloads, only
+// the limits are updated, so that requests still served by a replaced route table count as well.
+type CircuitBreaker struct {
+	mu         sync.Mutex
+	active     int
+	maxActive  int
+	waiting    []chan struct{} // closed once the waiting request is handed a slot
+	maxPending int
+	retries    atomic.Int64
+	maxRetries atomic.Int64
+}
+
+func NewCircuitBreaker(cfg schema.CircuitBreaker) *CircuitBreaker {
+	cb := &CircuitBreaker{}
+	cb.update(cfg)
+	return cb
+}
+
+// update replaces the limits. Requests over a lowered limit finish as they are, new ones wait until the
+// sink is back under it.
+func (cb *CircuitBreaker) update(cfg schema.CircuitBreaker) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.maxActive = ptr.Deref(cfg.MaxRequests, defaultMaxRequests)
+	cb.maxPending = ptr.Deref(cfg.MaxPendingRequests, defaultMaxPendingRequests)
+	cb.maxRetries.Store(int64(ptr.Deref(cfg.MaxRetries, defaultMaxRetries)))
+	cb.handOut()
+}
+
+// acquire takes a request slot, waiting for one while there is room in the pending queue. It returns
+// false when the request has to be turned away or the client gave up while waiting.
+func (cb *CircuitBreaker) acquire(ctx context.Context) (release func(), ok bool) {
+	if cb == nil {
+		return func() {}, true
+	}
+	cb.mu.Lock()
+	if cb.active < cb.maxActive {
+		cb.active++
+		cb.mu.Unlock()
+		return cb.release, true
+	}
+	if len(cb.waiting) >= cb.maxPending {
+		cb.mu.Unlock()
+		return nil, false
+	}
+	slot := make(chan struct{})
+	cb.waiting = append(cb.waiting, slot)
+	cb.mu.Unlock()
+
+	select {
+	case <-slot:
+		return cb.release, true
+	case <-ctx.Done():
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if i := slices.Index(cb.waiting, slot); i >= 0 {
+		cb.waiting = slices.Delete(cb.waiting, i, i+1)
+		return nil, false
+	}
+	// The slot was handed out just as the client gave up, it goes to the next one in line
+	cb.active--
+	cb.handOut()
+	return nil, false
+}
+
+func (cb *CircuitBreaker) release() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.active--
+	cb.handOut()
+}
+
+// handOut gives the free slots to the requests that have waited the longest
+func (cb *CircuitBreaker) handOut() {
+	for cb.active < cb.maxActive && len(cb.waiting) > 0 {
+		cb.active++
+		close(cb.waiting[0])
+		cb.waiting = cb.waiting[1:]
+	}
+}
+
+// acquireRetry takes one of the retry slots, it never waits
+func (cb *CircuitBreaker) acquireRetry() (release func(), ok bool) {
+	if cb == nil {
+		return func() {}, true
+	}
+	if cb.retries.Add(1) > cb.maxRetries.Load() {
+		cb.retries.Add(-1)
+		return nil, false
+	}
+	return func() { cb.retries.Add(-1) }, true
+}
+
+func writeOverloaded(w http.ResponseWriter) {
+	w.Header().Set(overloadedHeader, "true")
+	writeError(w, http.StatusServiceUnavailable, "upstream overloaded")
+}
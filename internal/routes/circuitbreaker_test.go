@@ -0,0 +1,124 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+func pending(cb *CircuitBreaker) int {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return len(cb.waiting)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	started := make(chan struct{}, 8)
+	release := make(chan struct{})
+	blocking := testUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("ok"))
+	})
+
+	newHandler := func(cb schema.CircuitBreaker) Handler {
+		h := newTestHandler([]schema.Upstream{blocking}, nil)
+		h.Sink.Breaker = NewCircuitBreaker(cb)
+		return h
+	}
+	serve := func(h Handler) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec
+	}
+
+	t.Run("fails fast once requests and pending requests are exhausted", func(t *testing.T) {
+		h := newHandler(schema.CircuitBreaker{MaxRequests: ptr.To(1), MaxPendingRequests: ptr.To(1)})
+		var wg sync.WaitGroup
+		results := make([]*httptest.ResponseRecorder, 2)
+		for i := range results {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results[i] = serve(h)
+			}()
+		}
+		<-started
+		// Give the second request time to queue up behind the first
+		deadline := time.Now().Add(time.Second)
+		for pending(h.Sink.Breaker) != 1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for the second request to be pending")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		rec := serve(h)
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected status 503, got %d", rec.Code)
+		}
+		if rec.Header().Get(overloadedHeader) != "true" {
+			t.Errorf("expected the %s header to be set", overloadedHeader)
+		}
+
+		release <- struct{}{}
+		<-started
+		release <- struct{}{}
+		wg.Wait()
+		for i, res := range results {
+			if res.Code != http.StatusOK {
+				t.Errorf("request %d: expected the admitted request to succeed, got %d", i, res.Code)
+			}
+		}
+	})
+
+	t.Run("retries stop once the retry budget is used up", func(t *testing.T) {
+		var attempts atomic.Int32
+		failing := testUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+			attempts.Add(1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		})
+		h := newTestHandler([]schema.Upstream{failing}, &schema.RetryPolicy{Attempts: ptr.To(3)})
+		h.Sink.Breaker = NewCircuitBreaker(schema.CircuitBreaker{MaxRetries: ptr.To(0)})
+		rec := serve(h)
+		if attempts.Load() != 1 {
+			t.Errorf("expected a single attempt without retry budget, got %d", attempts.Load())
+		}
+		if rec.Code != http.StatusServiceUnavailable || rec.Header().Get(overloadedHeader) != "" {
+			t.Errorf("expected the upstream response to be returned as-is, got %d", rec.Code)
+		}
+	})
+}
+
+func TestCircuitBreakerSurvivesReloads(t *testing.T) {
+	registry := NewEndpointRegistry()
+	cfg := schema.Sink{
+		Name:           "backend",
+		CircuitBreaker: &schema.CircuitBreaker{MaxRequests: ptr.To(1), MaxPendingRequests: ptr.To(0)},
+		Upstreams:      []schema.Upstream{{Address: "127.0.0.1", Port: 8080}},
+	}
+	sink := NewSink("app", cfg, registry)
+	release, ok := sink.Breaker.acquire(context.Background())
+	if !ok {
+		t.Fatalf("expected the first request to be admitted")
+	}
+
+	reloaded := NewSink("app", cfg, registry)
+	if _, ok := reloaded.Breaker.acquire(context.Background()); ok {
+		t.Errorf("expected the request of the replaced route table to still hold the only slot")
+	}
+
+	cfg.CircuitBreaker = &schema.CircuitBreaker{MaxRequests: ptr.To(2), MaxPendingRequests: ptr.To(0)}
+	raised := NewSink("app", cfg, registry)
+	if _, ok := raised.Breaker.acquire(context.Background()); !ok {
+		t.Errorf("expected a raised limit to admit a second request")
+	}
+	release()
+}
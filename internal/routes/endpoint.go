@@ -0,0 +1,276 @@
+package routes
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/maxcelant/jap/internal/schema"
+)
+
+// Endpoint is the live state of a single upstream within a sink. Endpoints are owned by an
+// EndpointRegistry rather than by a compiled handler chain, so that the state of an upstream
+// survives a config reload as long as the upstream itself is unchanged.
+type Endpoint struct {
+	Addr    string
+	healthy atomic.Bool
+	ejected atomic.Bool
+	// generation is shared with the other endpoints of the sink and is bumped on every availability change
+	generation *atomic.Uint64
+
+	// Outlier detection state, the counters besides consecutiveFailures are guarded by the outlier lock
+	// of the sink
+	consecutiveFailures atomic.Int64
+	ejections           int
+	lastEjectionEnd     time.Time
+}
+
+func (e *Endpoint) Healthy() bool {
+	return e.healthy.Load()
+}
+
+// SetHealthy records the result of an active health check
+func (e *Endpoint) SetHealthy(healthy bool) {
+	if e.healthy.Swap(healthy) != healthy {
+		e.generation.Add(1)
+	}
+}
+
+// Ejected reports whether outlier detection has currently taken the endpoint out of rotation
+func (e *Endpoint) Ejected() bool {
+	return e.ejected.Load()
+}
+
+// eject takes the endpoint out of rotation and schedules it to be put back once the duration passed
+func (e *Endpoint) eject(d time.Duration) {
+	e.lastEjectionEnd = time.Now().Add(d)
+	e.ejected.Store(true)
+	e.generation.Add(1)
+	time.AfterFunc(d, func() {
+		e.ejected.Store(false)
+		e.generation.Add(1)
+	})
+}
+
+// Available reports whether the endpoint should currently receive traffic
+func (e *Endpoint) Available() bool {
+	return e.Healthy() && !e.Ejected()
+}
+
+type endpointKey struct {
+	app, sink, addr string
+}
+
+type sinkKey struct {
+	app, sink string
+}
+
+// sinkState is the state of a sink that outlives the Sinks compiled for it
+type sinkState struct {
+	// generation changes whenever an endpoint of the sink changes availability, the sink compares it
+	// against the generation its strategy was built for to know when to rebuild
+	generation atomic.Uint64
+	// outliers is the lock of the outlier detectors of the sink
+	outliers sync.Mutex
+	// breaker is created along with the first circuit breaker config of the sink, nil until then
+	breaker *CircuitBreaker
+}
+
+// EndpointRegistry hands out the endpoints for every upstream of every sink
+type EndpointRegistry struct {
+	mu        sync.Mutex
+	endpoints map[endpointKey]*Endpoint
+	sinks     map[sinkKey]*sinkState
+}
+
+func NewEndpointRegistry() *EndpointRegistry {
+	return &EndpointRegistry{
+		endpoints: make(map[endpointKey]*Endpoint),
+		sinks:     make(map[sinkKey]*sinkState),
+	}
+}
+
+// Get returns the endpoint for the address in the given sink, creating a healthy one if it does not exist yet
+func (reg *EndpointRegistry) Get(app, sink, addr string) *Endpoint {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	k := endpointKey{app, sink, addr}
+	if e, ok := reg.endpoints[k]; ok {
+		return e
+	}
+	e := &Endpoint{Addr: addr, generation: &reg.sinkLocked(app, sink).generation}
+	e.healthy.Store(true)
+	reg.endpoints[k] = e
+	return e
+}
+
+func (reg *EndpointRegistry) sink(app, sink string) *sinkState {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.sinkLocked(app, sink)
+}
+
+// breaker returns the circuit breaker of the sink with its limits set to the config
+func (reg *EndpointRegistry) breaker(app, sink string, cfg schema.CircuitBreaker) *CircuitBreaker {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	state := reg.sinkLocked(app, sink)
+	if state.breaker == nil {
+		state.breaker = NewCircuitBreaker(cfg)
+	} else {
+		state.breaker.update(cfg)
+	}
+	return state.breaker
+}
+
+func (reg *EndpointRegistry) sinkLocked(app, sink string) *sinkState {
+	k := sinkKey{app, sink}
+	if s, ok := reg.sinks[k]; ok {
+		return s
+	}
+	s := &sinkState{}
+	reg.sinks[k] = s
+	return s
+}
+
+// Prune drops the endpoints and sinks of the app that are no longer referenced by any of its sinks,
+// along with the metric series of its removed routes, sinks and upstreams
+func (reg *EndpointRegistry) Prune(app schema.App) {
+	pruneMetrics(app)
+	keep := make(map[endpointKey]bool)
+	keepSinks := make(map[sinkKey]bool)
+	for _, s := range app.Sinks {
+		keepSinks[sinkKey{app.Name, s.Name}] = true
+		for _, addr := range upstreamAddrs(s.Upstreams) {
+			keep[endpointKey{app.Name, s.Name, addr}] = true
+		}
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for k := range reg.endpoints {
+		if k.app == app.Name && !keep[k] {
+			delete(reg.endpoints, k)
+		}
+	}
+	for k := range reg.sinks {
+		if k.app == app.Name && !keepSinks[k] {
+			delete(reg.sinks, k)
+		}
+	}
+}
+
+// Sink is the compiled form of a schema.Sink. Its strategy only ever sees the endpoints that are
+// currently available, and is rebuilt lazily whenever one of them changes availability. A rebuilt
+// strategy carries on from the state of the one it replaces.
+type Sink struct {
+	Name      string
+	Endpoints []*Endpoint
+	Outliers  *OutlierDetector // nil when outlier detection is disabled
+	Breaker   *CircuitBreaker  // nil when the sink has no circuit breaker
+	// RequestHeaders and ResponseHeaders are applied before the header operations of the route
+	RequestHeaders  *HeaderOps
+	ResponseHeaders *HeaderOps
+
+	config  schema.Sink
+	state   *sinkState
+	mu      sync.Mutex
+	current atomic.Pointer[sinkStrategy]
+}
+
+type sinkStrategy struct {
+	LoadbalanceStrategy
+	generation uint64
+}
+
+func NewSink(app string, sink schema.Sink, registry *EndpointRegistry) *Sink {
+	s := &Sink{
+		Name:            sink.Name,
+		Endpoints:       make([]*Endpoint, len(sink.Upstreams)),
+		RequestHeaders:  compileHeaderOps(sink.RequestHeaders),
+		ResponseHeaders: compileHeaderOps(sink.ResponseHeaders),
+		config:          sink,
+		state:           registry.sink(app, sink.Name),
+	}
+	for i, u := range sink.Upstreams {
+		s.Endpoints[i] = registry.Get(app, sink.Name, fmt.Sprintf("%s:%d", u.Address, u.Port))
+	}
+	if sink.OutlierDetection != nil {
+		s.Outliers = NewOutlierDetector(*sink.OutlierDetection, s.Endpoints, &s.state.outliers)
+	}
+	if sink.CircuitBreaker != nil {
+		s.Breaker = registry.breaker(app, sink.Name, *sink.CircuitBreaker)
+	}
+	return s
+}
+
+// Report passes the outcome of a request sent to the address on to outlier detection
+func (s *Sink) Report(addr string, failed bool) {
+	if s.Outliers == nil {
+		return
+	}
+	for _, e := range s.Endpoints {
+		if e.Addr == addr {
+			s.Outliers.Report(e, failed)
+			return
+		}
+	}
+}
+
+// untried returns a random available endpoint that is not in tried, or "" if there is none. Like the
+// strategy, it considers every endpoint when none is available.
+func (s *Sink) untried(tried map[string]bool) string {
+	var available, all []string
+	for _, e := range s.Endpoints {
+		if tried[e.Addr] {
+			continue
+		}
+		all = append(all, e.Addr)
+		if e.Available() {
+			available = append(available, e.Addr)
+		}
+	}
+	if !slices.ContainsFunc(s.Endpoints, (*Endpoint).Available) {
+		available = all
+	}
+	if len(available) == 0 {
+		return ""
+	}
+	return available[rand.Intn(len(available))]
+}
+
+// Strategy returns the load balancing strategy over the currently available endpoints. Callers must
+// report Done to the same strategy they picked from, since a rebuild creates a fresh one.
+func (s *Sink) Strategy() LoadbalanceStrategy {
+	gen := s.state.generation.Load()
+	if cur := s.current.Load(); cur != nil && cur.generation == gen {
+		return cur.LoadbalanceStrategy
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Another request may have rebuilt the strategy while we were waiting on the lock
+	if cur := s.current.Load(); cur != nil && cur.generation == gen {
+		return cur.LoadbalanceStrategy
+	}
+	available := s.config
+	available.Upstreams = nil
+	for i, e := range s.Endpoints {
+		if e.Available() {
+			available.Upstreams = append(available.Upstreams, s.config.Upstreams[i])
+		}
+	}
+	// If nothing is available we would rather keep trying every upstream than fail every request
+	if len(available.Upstreams) == 0 {
+		available.Upstreams = s.config.Upstreams
+	}
+	strategy := compileRoutingStrategy(available)
+	if prev := s.current.Load(); prev != nil {
+		if c, ok := strategy.(carrier); ok {
+			c.carry(prev.LoadbalanceStrategy)
+		}
+	}
+	s.current.Store(&sinkStrategy{strategy, gen})
+	return strategy
+}
@@ -0,0 +1,116 @@
+package routes
+
+import (
+	"testing"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+func TestSinkStrategy(t *testing.T) {
+	registry := NewEndpointRegistry()
+	sink := NewSink("app", schema.Sink{
+		Name:     "backend",
+		Strategy: ptr.To("round-robin"),
+		Upstreams: []schema.Upstream{
+			{Address: "127.0.0.1", Port: 8080},
+			{Address: "127.0.0.1", Port: 8081},
+		},
+	}, registry)
+
+	picks := func() map[string]int {
+		counts := make(map[string]int)
+		s := sink.Strategy()
+		for i := 0; i < 10; i++ {
+			counts[s.Pick(nil)]++
+		}
+		return counts
+	}
+
+	t.Run("unhealthy endpoints are taken out of rotation", func(t *testing.T) {
+		sink.Endpoints[0].SetHealthy(false)
+		counts := picks()
+		if counts["127.0.0.1:8080"] != 0 || counts["127.0.0.1:8081"] != 10 {
+			t.Errorf("expected only the healthy upstream to be picked, got %v", counts)
+		}
+	})
+
+	t.Run("every endpoint is used when none are available", func(t *testing.T) {
+		sink.Endpoints[1].SetHealthy(false)
+		counts := picks()
+		if counts["127.0.0.1:8080"] != 5 || counts["127.0.0.1:8081"] != 5 {
+			t.Errorf("expected both upstreams to be picked, got %v", counts)
+		}
+	})
+
+	t.Run("recovered endpoints are restored", func(t *testing.T) {
+		sink.Endpoints[0].SetHealthy(true)
+		counts := picks()
+		if counts["127.0.0.1:8080"] != 10 {
+			t.Errorf("expected only the recovered upstream to be picked, got %v", counts)
+		}
+	})
+
+	t.Run("endpoints are shared with sinks compiled later", func(t *testing.T) {
+		reloaded := NewSink("app", schema.Sink{
+			Name:      "backend",
+			Upstreams: []schema.Upstream{{Address: "127.0.0.1", Port: 8081}},
+		}, registry)
+		if reloaded.Endpoints[0] != sink.Endpoints[1] {
+			t.Errorf("expected the unchanged upstream to keep its endpoint")
+		}
+	})
+}
+
+func TestSinkStrategyRebuilds(t *testing.T) {
+	upstreams := []schema.Upstream{
+		{Address: "127.0.0.1", Port: 8080},
+		{Address: "127.0.0.1", Port: 8081},
+		{Address: "127.0.0.1", Port: 8082},
+	}
+
+	t.Run("changes in other sinks leave the strategy alone", func(t *testing.T) {
+		registry := NewEndpointRegistry()
+		sink := NewSink("app", schema.Sink{Name: "a", Strategy: ptr.To("round-robin"), Upstreams: upstreams}, registry)
+		other := NewSink("other", schema.Sink{Name: "a", Strategy: ptr.To("round-robin"), Upstreams: upstreams}, registry)
+		before := sink.Strategy()
+		other.Endpoints[0].SetHealthy(false)
+		if sink.Strategy() != before {
+			t.Errorf("expected the strategy to be kept when an endpoint of another sink changes")
+		}
+	})
+
+	t.Run("round robin carries on from where it was", func(t *testing.T) {
+		registry := NewEndpointRegistry()
+		sink := NewSink("app", schema.Sink{Name: "a", Strategy: ptr.To("round-robin"), Upstreams: upstreams}, registry)
+		sink.Strategy().Pick(nil)
+		sink.Endpoints[2].SetHealthy(false)
+		if got := sink.Strategy().Pick(nil); got != "127.0.0.1:8081" {
+			t.Errorf("expected the pick after 127.0.0.1:8080 to be 127.0.0.1:8081, got %q", got)
+		}
+	})
+
+	t.Run("least request keeps its in-flight counts", func(t *testing.T) {
+		registry := NewEndpointRegistry()
+		sink := NewSink("app", schema.Sink{Name: "a", Strategy: ptr.To("least-request"), Upstreams: upstreams}, registry)
+		first := sink.Strategy()
+		busy := first.Pick(nil)
+		// Take out an endpoint that was not picked, the busy one has to stay out of the next picks
+		for _, e := range sink.Endpoints {
+			if e.Addr != busy {
+				e.SetHealthy(false)
+				break
+			}
+		}
+		rebuilt := sink.Strategy()
+		if rebuilt == first {
+			t.Fatalf("expected the strategy to be rebuilt")
+		}
+		got := rebuilt.Pick(nil)
+		if got == busy {
+			t.Errorf("expected the idle endpoint to be picked over %q", busy)
+		}
+		first.Done(busy)
+		rebuilt.Done(got)
+	})
+}
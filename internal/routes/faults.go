@@ -0,0 +1,106 @@
+package routes
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+const defaultFaultPercent = 100
+
+// Faults is the compiled form of schema.Faults
+type Faults struct {
+	Header *HeaderMatcher // nil when every request is eligible
+	Delay  *FaultDelay
+	Abort  *FaultAbort
+}
+
+// FaultDelay holds requests back for Fixed, or for a random time between Min and Max when Fixed is zero
+type FaultDelay struct {
+	Percent  float64
+	Fixed    time.Duration
+	Min, Max time.Duration
+}
+
+// FaultAbort fails requests with Status, or drops their connection when Reset is set
+type FaultAbort struct {
+	Percent float64
+	Status  int
+	Reset   bool
+}
+
+func compileFaults(f *schema.Faults) (*Faults, error) {
+	if f == nil {
+		return nil, nil
+	}
+	faults := &Faults{}
+	if f.Header != nil {
+		m, err := compileHeaderMatcher(*f.Header)
+		if err != nil {
+			return nil, err
+		}
+		faults.Header = &m
+	}
+	if d := f.Delay; d != nil {
+		faults.Delay = &FaultDelay{
+			Percent: ptr.Deref(d.Percent, defaultFaultPercent),
+			Fixed:   time.Duration(ptr.Deref(d.Fixed, 0)),
+			Min:     time.Duration(ptr.Deref(d.Min, 0)),
+			Max:     time.Duration(ptr.Deref(d.Max, 0)),
+		}
+	}
+	if a := f.Abort; a != nil {
+		faults.Abort = &FaultAbort{
+			Percent: ptr.Deref(a.Percent, defaultFaultPercent),
+			Status:  ptr.Deref(a.Status, 0),
+			Reset:   a.Reset,
+		}
+	}
+	return faults, nil
+}
+
+// faultInjection delays and aborts a share of the requests before they reach the route. The delay comes
+// first, so a request can be both delayed and aborted.
+func faultInjection(f *Faults) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if f.Header != nil && !f.Header.Match(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if d := f.Delay; d != nil && sampled(d.Percent) {
+				timer := time.NewTimer(d.duration())
+				select {
+				case <-timer.C:
+				case <-r.Context().Done():
+					timer.Stop()
+					return
+				}
+			}
+			if a := f.Abort; a != nil && sampled(a.Percent) {
+				if a.Reset {
+					// The server drops the connection without writing a response, or resets the HTTP/2 stream
+					panic(http.ErrAbortHandler)
+				}
+				writeError(w, a.Status, "fault injected")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (d *FaultDelay) duration() time.Duration {
+	if d.Fixed > 0 || d.Max <= d.Min {
+		return max(d.Fixed, d.Min)
+	}
+	return d.Min + time.Duration(rand.Int63n(int64(d.Max-d.Min)))
+}
+
+// sampled reports whether a request falls in the given percentage
+func sampled(percent float64) bool {
+	return rand.Float64()*100 < percent
+}
@@ -0,0 +1,63 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/utils/ptr"
+)
+
+func TestFaultInjection(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	chaos := ptr.To(HeaderMatcher{Name: "x-chaos", Present: ptr.To(true)})
+
+	tests := []struct {
+		name     string
+		faults   Faults
+		chaos    bool
+		status   int
+		minDelay time.Duration
+	}{
+		{name: "abort with a status", faults: Faults{Abort: &FaultAbort{Percent: 100, Status: 503}}, status: 503},
+		{name: "unsampled abort", faults: Faults{Abort: &FaultAbort{Percent: 0, Status: 503}}, status: 200},
+		{name: "gated abort without the header", faults: Faults{Header: chaos, Abort: &FaultAbort{Percent: 100, Status: 503}}, status: 200},
+		{name: "gated abort with the header", faults: Faults{Header: chaos, Abort: &FaultAbort{Percent: 100, Status: 418}}, chaos: true, status: 418},
+		{name: "fixed delay", faults: Faults{Delay: &FaultDelay{Percent: 100, Fixed: 50 * time.Millisecond}}, status: 200, minDelay: 50 * time.Millisecond},
+		{name: "distributed delay", faults: Faults{Delay: &FaultDelay{Percent: 100, Min: 20 * time.Millisecond, Max: 40 * time.Millisecond}}, status: 200, minDelay: 20 * time.Millisecond},
+		{
+			name:     "delay then abort",
+			faults:   Faults{Delay: &FaultDelay{Percent: 100, Fixed: 20 * time.Millisecond}, Abort: &FaultAbort{Percent: 100, Status: 500}},
+			status:   500,
+			minDelay: 20 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.chaos {
+				r.Header.Set("x-chaos", "1")
+			}
+			rec := httptest.NewRecorder()
+			start := time.Now()
+			faultInjection(&tt.faults)(ok).ServeHTTP(rec, r)
+			if rec.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, rec.Code)
+			}
+			if elapsed := time.Since(start); elapsed < tt.minDelay {
+				t.Errorf("expected a delay of at least %v, got %v", tt.minDelay, elapsed)
+			}
+		})
+	}
+
+	t.Run("reset drops the connection", func(t *testing.T) {
+		server := httptest.NewServer(faultInjection(&Faults{Abort: &FaultAbort{Percent: 100, Reset: true}})(ok))
+		defer server.Close()
+		res, err := http.Get(server.URL)
+		if err == nil {
+			res.Body.Close()
+			t.Errorf("expected the connection to be dropped, got status %d", res.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package routes
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hopHeaders only apply to a single connection and must not be forwarded by a proxy (RFC 9110 section 7.6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // non-standard but still sent by some clients
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders strips the hop-by-hop headers, including any header named by the Connection header
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// prepareOutgoing rewrites the headers of a request that is about to be sent upstream
+func prepareOutgoing(in, out *http.Request) {
+	// Trailers are the one thing Te may ask for, and go's transport needs to know so it can pass them along
+	trailers := strings.Contains(strings.ToLower(strings.Join(in.Header.Values("Te"), ",")), "trailers")
+	removeHopHeaders(out.Header)
+	if trailers {
+		out.Header.Set("Te", "trailers")
+	}
+
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+	clientIP := clientIP(in)
+	if prior := out.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		out.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+clientIP)
+	} else {
+		out.Header.Set("X-Forwarded-For", clientIP)
+	}
+	out.Header.Set("X-Forwarded-Proto", proto)
+	out.Header.Set("X-Forwarded-Host", in.Host)
+
+	// RFC 7239, IPv6 addresses have to be bracketed and quoted
+	node := clientIP
+	if strings.Contains(node, ":") {
+		node = `"[` + node + `]"`
+	}
+	element := "for=" + node + ";host=" + quoteForwarded(in.Host) + ";proto=" + proto
+	if prior := out.Header.Values("Forwarded"); len(prior) > 0 {
+		element = strings.Join(prior, ", ") + ", " + element
+	}
+	out.Header.Set("Forwarded", element)
+}
+
+// clientIP is the address of the peer that sent the request, without its port
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// quoteForwarded quotes a Forwarded parameter value when it is not a plain token
+func quoteForwarded(v string) string {
+	for _, c := range v {
+		if !(c == '-' || c == '.' || c == '_' || c == '~' || c == '!' || c == '*' || c == '+' ||
+			('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')) {
+			return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+		}
+	}
+	return v
+}
+
+// writeResponse forwards the upstream response as-is, minus the hop-by-hop headers
+func writeResponse(w http.ResponseWriter, res *http.Response) error {
+	removeHopHeaders(res.Header)
+	for k, vv := range res.Header {
+		w.Header()[k] = vv
+	}
+	w.WriteHeader(res.StatusCode)
+
+	// Responses without a known length are likely streams (like server-sent events), flush every write
+	// so the client sees the data as soon as the upstream sends it
+	var err error
+	if res.ContentLength == -1 {
+		err = copyFlushing(w, res.Body)
+	} else {
+		_, err = io.Copy(w, res.Body)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Trailers are only known once the body was read
+	for k, vv := range res.Trailer {
+		w.Header()[http.TrailerPrefix+k] = vv
+	}
+	return nil
+}
+
+func copyFlushing(w http.ResponseWriter, r io.Reader) error {
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			// Not every writer can flush, in which case the data simply goes out when it is buffered
+			rc.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package routes
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/maxcelant/jap/internal/schema"
+)
+
+func TestForwarding(t *testing.T) {
+	var seen http.Header
+	backend := testUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Clone()
+		seen.Set("Host", r.Host)
+		w.Header().Set("Location", "/elsewhere")
+		w.Header().Set("X-Backend", "v1")
+		w.Header().Set("Connection", "X-Secret")
+		w.Header().Set("X-Secret", "hop")
+		w.Header().Set("Trailer", "X-Checksum")
+		w.WriteHeader(http.StatusFound)
+		w.Write([]byte("moved"))
+		w.Header().Set("X-Checksum", "abc")
+	})
+	proxy := httptest.NewServer(newTestHandler([]schema.Upstream{backend}, nil))
+	defer proxy.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/pay", nil)
+	req.Host = "shop.example.com"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	req.Header.Set("Connection", "X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "secret")
+	req.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	t.Run("upstream status, headers, body and trailers are preserved", func(t *testing.T) {
+		if res.StatusCode != http.StatusFound {
+			t.Errorf("expected status 302, got %d", res.StatusCode)
+		}
+		if got := res.Header.Get("Location"); got != "/elsewhere" {
+			t.Errorf("expected the Location header to be forwarded, got %q", got)
+		}
+		if got := res.Header.Get("X-Backend"); got != "v1" {
+			t.Errorf("expected the X-Backend header to be forwarded, got %q", got)
+		}
+		if string(body) != "moved" {
+			t.Errorf("expected body %q, got %q", "moved", body)
+		}
+		if got := res.Trailer.Get("X-Checksum"); got != "abc" {
+			t.Errorf("expected the X-Checksum trailer to be forwarded, got %q", got)
+		}
+	})
+
+	t.Run("hop-by-hop headers are stripped in both directions", func(t *testing.T) {
+		if got := res.Header.Get("X-Secret"); got != "" {
+			t.Errorf("expected the response header named by Connection to be stripped, got %q", got)
+		}
+		for _, name := range []string{"X-Client-Hop", "Proxy-Authorization"} {
+			if got := seen.Get(name); got != "" {
+				t.Errorf("expected request header %s to be stripped, got %q", name, got)
+			}
+		}
+	})
+
+	t.Run("forwarding headers are added", func(t *testing.T) {
+		expected := map[string]string{
+			"X-Forwarded-For":   "203.0.113.9, 127.0.0.1",
+			"X-Forwarded-Proto": "http",
+			"X-Forwarded-Host":  "shop.example.com",
+			"Forwarded":         "for=127.0.0.1;host=shop.example.com;proto=http",
+			"Host":              "shop.example.com",
+		}
+		for name, want := range expected {
+			if got := seen.Get(name); got != want {
+				t.Errorf("expected %s %q, got %q", name, want, got)
+			}
+		}
+	})
+}
+
+func TestForwardingStreams(t *testing.T) {
+	next := make(chan struct{})
+	backend := testUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 2; i++ {
+			w.Write([]byte("data: tick\n"))
+			w.(http.Flusher).Flush()
+			<-next
+		}
+	})
+	proxy := httptest.NewServer(newTestHandler([]schema.Upstream{backend}, nil))
+	defer proxy.Close()
+
+	res, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer res.Body.Close()
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case line := <-lines:
+			if line != "data: tick" {
+				t.Errorf("event %d: expected %q, got %q", i, "data: tick", line)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d was not flushed to the client while the stream was open", i)
+		}
+		next <- struct{}{}
+	}
+}
+
+func TestForwardingTruncatedBody(t *testing.T) {
+	backend := testUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		// Dropping the connection ends the chunked body without its final chunk
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	})
+	proxy := httptest.NewServer(newTestHandler([]schema.Upstream{backend}, nil))
+	defer proxy.Close()
+
+	res, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", res.StatusCode)
+	}
+	if _, err := io.ReadAll(res.Body); err == nil {
+		t.Errorf("expected the client to see the truncated body as an error")
+	}
+}
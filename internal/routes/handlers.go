@@ -1,6 +1,9 @@
 package routes
 
-import "net/http"
+import (
+	"encoding/json"
+	"net/http"
+)
 
 type Middleware func(http.Handler) http.Handler
 
@@ -9,3 +12,17 @@ type MiddlewareHandler interface {
 }
 
 var emptyHandler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("No matching route found")) })
+
+// errorBody is the structured body of the responses the proxy generates itself
+type errorBody struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// writeError replies with a JSON error body, so that clients can tell proxy errors apart from upstream ones
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorBody{Status: status, Error: msg})
+}
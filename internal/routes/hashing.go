@@ -0,0 +1,137 @@
+package routes
+
+import (
+	"cmp"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/maxcelant/jap/internal/schema"
+)
+
+// ringReplicas is the number of points every unit of weight gets on the hash ring. More points
+// spread the keys more evenly at the cost of a larger ring.
+const ringReplicas = 160
+
+// HashKeyFunc extracts the key a request should be hashed on. It returns false when the request
+// does not carry the key, in which case the strategy falls back to a random pick.
+type HashKeyFunc func(*http.Request) (string, bool)
+
+// RingHashStrategy is a consistent hash (ketama style) strategy. Every address is placed on a ring
+// of 64-bit points proportionally to its weight, and a request goes to the first point at or after
+// the hash of its key. Adding or removing an address only moves the keys that land next to its
+// points, so roughly 1/n of the keys are remapped instead of nearly all of them.
+type RingHashStrategy struct {
+	Key    HashKeyFunc
+	points []uint64
+	addrs  []string // addrs[i] owns points[i]
+}
+
+func NewRingHashStrategy(addrWeights []AddrWeight, key HashKeyFunc) *RingHashStrategy {
+	type point struct {
+		hash uint64
+		addr string
+	}
+	// Without a single positive weight every address gets an equal share rather than none at all
+	equal := !slices.ContainsFunc(addrWeights, func(aw AddrWeight) bool { return aw.Weight > 0 })
+	var ring []point
+	for _, aw := range addrWeights {
+		weight := aw.Weight
+		if equal {
+			weight = 1
+		}
+		for i := 0; i < weight*ringReplicas; i++ {
+			ring = append(ring, point{hashString(aw.Addr + "-" + strconv.Itoa(i)), aw.Addr})
+		}
+	}
+	slices.SortFunc(ring, func(a, b point) int { return cmp.Compare(a.hash, b.hash) })
+	s := &RingHashStrategy{
+		Key:    key,
+		points: make([]uint64, len(ring)),
+		addrs:  make([]string, len(ring)),
+	}
+	for i, p := range ring {
+		s.points[i], s.addrs[i] = p.hash, p.addr
+	}
+	return s
+}
+
+func (s *RingHashStrategy) Pick(r *http.Request) string {
+	if len(s.addrs) == 0 {
+		return ""
+	}
+	if r == nil || s.Key == nil {
+		return s.addrs[rand.Intn(len(s.addrs))]
+	}
+	key, ok := s.Key(r)
+	if !ok {
+		return s.addrs[rand.Intn(len(s.addrs))]
+	}
+	return s.lookup(key)
+}
+
+func (s *RingHashStrategy) Done(string) {}
+
+// lookup finds the owner of the first point at or after the hash of the key, wrapping around the ring
+func (s *RingHashStrategy) lookup(key string) string {
+	i, _ := slices.BinarySearch(s.points, hashString(key))
+	if i == len(s.points) {
+		i = 0
+	}
+	return s.addrs[i]
+}
+
+// hashString is 64-bit FNV-1a followed by the splitmix64 finalizer. FNV on its own clusters badly for
+// the short, nearly identical strings used as ring points, the finalizer spreads them over the ring.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// compileHashKey turns the sink hash policy into a key extractor, defaulting to the client IP
+func compileHashKey(policy *schema.HashPolicy) HashKeyFunc {
+	switch {
+	case policy == nil || policy.SourceIP:
+		return sourceIPKey
+	case policy.Header != nil:
+		name := *policy.Header
+		return func(r *http.Request) (string, bool) {
+			v := r.Header.Get(name)
+			return v, v != ""
+		}
+	case policy.Cookie != nil:
+		name := *policy.Cookie
+		return func(r *http.Request) (string, bool) {
+			c, err := r.Cookie(name)
+			if err != nil || c.Value == "" {
+				return "", false
+			}
+			return c.Value, true
+		}
+	case policy.QueryParam != nil:
+		name := *policy.QueryParam
+		return func(r *http.Request) (string, bool) {
+			v := r.URL.Query().Get(name)
+			return v, v != ""
+		}
+	}
+	return sourceIPKey
+}
+
+func sourceIPKey(r *http.Request) (string, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr, r.RemoteAddr != ""
+	}
+	return host, true
+}
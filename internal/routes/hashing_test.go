@@ -0,0 +1,126 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+func TestRingHashStrategy(t *testing.T) {
+	weights := []AddrWeight{
+		{Addr: "a:1", Weight: 1},
+		{Addr: "b:1", Weight: 1},
+		{Addr: "c:1", Weight: 1},
+		{Addr: "d:1", Weight: 1},
+	}
+
+	t.Run("same key always maps to the same address", func(t *testing.T) {
+		s := NewRingHashStrategy(weights, nil)
+		for i := 0; i < 100; i++ {
+			key := "user-" + strconv.Itoa(i)
+			if first, second := s.lookup(key), s.lookup(key); first != second {
+				t.Errorf("key %q mapped to both %q and %q", key, first, second)
+			}
+		}
+	})
+
+	t.Run("keys are spread across all addresses", func(t *testing.T) {
+		s := NewRingHashStrategy(weights, nil)
+		counts := make(map[string]int)
+		for i := 0; i < 10000; i++ {
+			counts[s.lookup("user-"+strconv.Itoa(i))]++
+		}
+		for _, aw := range weights {
+			// A perfect split is 2500, allow generous slack for the ring's variance
+			if counts[aw.Addr] < 1800 || counts[aw.Addr] > 3200 {
+				t.Errorf("expected %q to own roughly 2500 keys, got %d", aw.Addr, counts[aw.Addr])
+			}
+		}
+	})
+
+	t.Run("removing an address only remaps its own keys", func(t *testing.T) {
+		before := NewRingHashStrategy(weights, nil)
+		after := NewRingHashStrategy(weights[:3], nil)
+		moved := 0
+		for i := 0; i < 10000; i++ {
+			key := "user-" + strconv.Itoa(i)
+			prev, next := before.lookup(key), after.lookup(key)
+			if prev == "d:1" {
+				moved++
+				continue
+			}
+			if prev != next {
+				t.Fatalf("key %q moved from %q to %q even though its address was not removed", key, prev, next)
+			}
+		}
+		if moved > 3200 {
+			t.Errorf("expected roughly a quarter of the keys to move, got %d", moved)
+		}
+	})
+
+	t.Run("picks from the request key and falls back when it is missing", func(t *testing.T) {
+		s := NewRingHashStrategy(weights, compileHashKey(&schema.HashPolicy{Header: ptr.To("x-user")}))
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-user", "alice")
+		want := s.lookup("alice")
+		for i := 0; i < 10; i++ {
+			if got := s.Pick(r); got != want {
+				t.Fatalf("expected %q for a keyed request, got %q", want, got)
+			}
+		}
+		if got := s.Pick(httptest.NewRequest(http.MethodGet, "/", nil)); got == "" {
+			t.Errorf("expected a fallback address for an unkeyed request")
+		}
+	})
+
+	t.Run("does not panic without a positive weight", func(t *testing.T) {
+		s := NewRingHashStrategy([]AddrWeight{{Addr: "a:1", Weight: 0}}, sourceIPKey)
+		if got := s.Pick(httptest.NewRequest(http.MethodGet, "/", nil)); got != "a:1" {
+			t.Errorf("expected %q, got %q", "a:1", got)
+		}
+		if got := NewRingHashStrategy(nil, nil).Pick(nil); got != "" {
+			t.Errorf("expected no address from an empty ring, got %q", got)
+		}
+	})
+}
+
+func TestCompileHashKey(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/pay?session=q1", nil)
+	r.RemoteAddr = "10.0.0.7:51234"
+	r.Header.Set("x-user", "h1")
+	r.AddCookie(&http.Cookie{Name: "session", Value: "c1"})
+
+	tests := []struct {
+		name     string
+		policy   *schema.HashPolicy
+		expected string
+	}{
+		{name: "nil policy uses source IP", policy: nil, expected: "10.0.0.7"},
+		{name: "source IP", policy: &schema.HashPolicy{SourceIP: true}, expected: "10.0.0.7"},
+		{name: "header", policy: &schema.HashPolicy{Header: ptr.To("x-user")}, expected: "h1"},
+		{name: "cookie", policy: &schema.HashPolicy{Cookie: ptr.To("session")}, expected: "c1"},
+		{name: "query parameter", policy: &schema.HashPolicy{QueryParam: ptr.To("session")}, expected: "q1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, ok := compileHashKey(tt.policy)(r)
+			if !ok {
+				t.Fatalf("expected a key to be found")
+			}
+			if key != tt.expected {
+				t.Errorf("expected key %q, got %q", tt.expected, key)
+			}
+		})
+	}
+
+	t.Run("missing header is reported", func(t *testing.T) {
+		if _, ok := compileHashKey(&schema.HashPolicy{Header: ptr.To("x-missing")})(r); ok {
+			t.Errorf("expected no key for a missing header")
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package routes
+
+import (
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/maxcelant/jap/internal/schema"
+)
+
+// requestIDHeader carries the ID of a request, both to the upstream and back to the client
+const requestIDHeader = "X-Request-Id"
+
+// HeaderOps is the compiled form of schema.HeaderOps. A nil HeaderOps leaves the headers alone.
+type HeaderOps struct {
+	Set    []headerValue
+	Add    []headerValue
+	Remove []string
+}
+
+type headerValue struct {
+	Name  string
+	Value string
+	// expand is false when the value has no variables and can be used as it is
+	expand bool
+}
+
+func compileHeaderOps(ops *schema.HeaderOps) *HeaderOps {
+	if ops == nil {
+		return nil
+	}
+	compiled := &HeaderOps{Remove: ops.Remove}
+	compiled.Set = compileHeaderValues(ops.Set)
+	compiled.Add = compileHeaderValues(ops.Add)
+	return compiled
+}
+
+func compileHeaderValues(values map[string]string) []headerValue {
+	hv := make([]headerValue, 0, len(values))
+	for name, value := range values {
+		hv = append(hv, headerValue{http.CanonicalHeaderKey(name), value, strings.Contains(value, "$")})
+	}
+	// Map order is random, sorting keeps repeated adds in a stable order
+	slices.SortFunc(hv, func(a, b headerValue) int { return strings.Compare(a.Name, b.Name) })
+	return hv
+}
+
+// headerVars are the values header operations can refer to
+type headerVars struct {
+	clientIP  string
+	route     string
+	upstream  string
+	requestID string
+}
+
+func (v headerVars) lookup(name string) string {
+	switch name {
+	case "client_ip":
+		return v.clientIP
+	case "route":
+		return v.route
+	case "upstream":
+		return v.upstream
+	case "request_id":
+		return v.requestID
+	case "$":
+		// $$ is a literal $
+		return "$"
+	}
+	return ""
+}
+
+func (ops *HeaderOps) apply(h http.Header, vars headerVars) {
+	if ops == nil {
+		return
+	}
+	for _, name := range ops.Remove {
+		h.Del(name)
+	}
+	for _, hv := range ops.Set {
+		h.Set(hv.Name, hv.value(vars))
+	}
+	for _, hv := range ops.Add {
+		h.Add(hv.Name, hv.value(vars))
+	}
+}
+
+func (hv headerValue) value(vars headerVars) string {
+	if !hv.expand {
+		return hv.Value
+	}
+	return os.Expand(hv.Value, vars.lookup)
+}
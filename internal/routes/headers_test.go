@@ -0,0 +1,84 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/maxcelant/jap/internal/schema"
+)
+
+func TestHeaderOps(t *testing.T) {
+	var seen http.Header
+	backend := testUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Clone()
+		w.Header().Set("X-Internal-Trace", "secret")
+		w.Header().Set("Server", "backend/1.2")
+		w.Header().Add("Cache-Control", "private")
+	})
+	upstream := upstreamAddrs([]schema.Upstream{backend})[0]
+	h, err := Compile(schema.App{
+		Name: "app",
+		Routes: []schema.Route{{
+			Name: "payments",
+			Path: "/pay",
+			Sink: "backend",
+			RequestHeaders: &schema.HeaderOps{
+				Set:    map[string]string{"x-tenant": "route", "x-token": "a$$b"},
+				Add:    map[string]string{"x-via": "${route} from ${client_ip} to ${upstream} as ${request_id}"},
+				Remove: []string{"cookie"},
+			},
+			ResponseHeaders: &schema.HeaderOps{
+				Set:    map[string]string{"server": "jap"},
+				Remove: []string{"x-internal-trace"},
+			},
+		}},
+		Sinks: []schema.Sink{{
+			Name:      "backend",
+			Upstreams: []schema.Upstream{backend},
+			RequestHeaders: &schema.HeaderOps{
+				Set: map[string]string{"authorization": "Bearer upstream-token", "x-tenant": "sink"},
+			},
+			ResponseHeaders: &schema.HeaderOps{
+				Add: map[string]string{"cache-control": "no-transform"},
+			},
+		}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/pay", nil)
+	r.RemoteAddr = "203.0.113.9:4711"
+	r.Header.Set("Cookie", "session=abc")
+	r.Header.Set("X-Request-Id", "req-1")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+
+	t.Run("request headers", func(t *testing.T) {
+		expected := map[string]string{
+			"Authorization": "Bearer upstream-token",
+			"X-Tenant":      "route",
+			"X-Token":       "a$b",
+			"X-Via":         "payments from 203.0.113.9 to " + upstream + " as req-1",
+			"Cookie":        "",
+		}
+		for name, want := range expected {
+			if got := seen.Get(name); got != want {
+				t.Errorf("expected %s %q, got %q", name, want, got)
+			}
+		}
+	})
+
+	t.Run("response headers", func(t *testing.T) {
+		if got := rec.Header().Get("Server"); got != "jap" {
+			t.Errorf("expected Server %q, got %q", "jap", got)
+		}
+		if got := rec.Header().Get("X-Internal-Trace"); got != "" {
+			t.Errorf("expected X-Internal-Trace to be removed, got %q", got)
+		}
+		if got := rec.Header().Values("Cache-Control"); len(got) != 2 || got[1] != "no-transform" {
+			t.Errorf("expected Cache-Control to be added to, got %q", got)
+		}
+	})
+}
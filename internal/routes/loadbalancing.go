@@ -2,21 +2,47 @@ package routes
 
 import (
 	"math/rand"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
 )
 
 type LoadbalanceStrategy interface {
-	Pick() string
+	// Pick chooses the upstream address the given request should be sent to, or "" when there is none
+	Pick(*http.Request) string
+	// Done is called once the request sent to the picked address has completed, so that
+	// strategies which care about in-flight requests can keep track of them
+	Done(addr string)
+}
+
+// tracker is implemented by strategies that count the requests in flight, so that a request sent to
+// an address that was not picked from them is still counted until it is reported Done
+type tracker interface {
+	track(addr string)
+}
+
+// carrier is implemented by strategies with state worth keeping when a sink rebuilds its strategy over
+// a new set of available endpoints, so that the rebuild does not start them over
+type carrier interface {
+	// carry takes over the state of the strategy that is replaced
+	carry(prev LoadbalanceStrategy)
 }
 
 type RandomStrategy struct {
 	Addrs []string
 }
 
-func (rs RandomStrategy) Pick() string {
+func (rs RandomStrategy) Pick(*http.Request) string {
+	if len(rs.Addrs) == 0 {
+		return ""
+	}
 	i := rand.Intn(len(rs.Addrs))
 	return rs.Addrs[i]
 }
 
+func (rs RandomStrategy) Done(string) {}
+
 type AddrWeight struct {
 	Addr   string
 	Weight int
@@ -26,17 +52,226 @@ type RandomWeightStrategy struct {
 	AddrWeights []AddrWeight
 }
 
-func (rs RandomWeightStrategy) Pick() string {
+func (rs RandomWeightStrategy) Pick(*http.Request) string {
 	total := 0
 	subsets := make([]int, len(rs.AddrWeights))
 	for i, aw := range rs.AddrWeights {
 		total += aw.Weight
 		subsets[i] = total
 	}
-	i, target := rand.Intn(total), 0
-	// TODO: This can be improved using binary search
-	for subsets[i] < target {
-		i++
+	// Weights that add up to nothing cannot be drawn from, every address gets an equal chance instead
+	if total <= 0 {
+		if len(rs.AddrWeights) == 0 {
+			return ""
+		}
+		return rs.AddrWeights[rand.Intn(len(rs.AddrWeights))].Addr
 	}
+	// Find the first running total that is strictly greater than the target
+	i, _ := slices.BinarySearch(subsets, rand.Intn(total)+1)
 	return rs.AddrWeights[i].Addr
 }
+
+func (rs RandomWeightStrategy) Done(string) {}
+
+// RoundRobinStrategy hands out the addresses in order, wrapping around once it reaches the end.
+// It is safe for concurrent use.
+type RoundRobinStrategy struct {
+	Addrs []string
+	next  atomic.Uint64
+}
+
+func NewRoundRobinStrategy(addrs []string) *RoundRobinStrategy {
+	return &RoundRobinStrategy{Addrs: addrs}
+}
+
+func (rs *RoundRobinStrategy) Pick(*http.Request) string {
+	if len(rs.Addrs) == 0 {
+		return ""
+	}
+	n := rs.next.Add(1) - 1
+	return rs.Addrs[n%uint64(len(rs.Addrs))]
+}
+
+func (rs *RoundRobinStrategy) Done(string) {}
+
+// carry continues with the address the previous strategy would have handed out next, or the first one
+// after it that is still around
+func (rs *RoundRobinStrategy) carry(prev LoadbalanceStrategy) {
+	p, ok := prev.(*RoundRobinStrategy)
+	if !ok || len(p.Addrs) == 0 {
+		return
+	}
+	n := p.next.Load()
+	for j := range uint64(len(p.Addrs)) {
+		if i := slices.Index(rs.Addrs, p.Addrs[(n+j)%uint64(len(p.Addrs))]); i >= 0 {
+			rs.next.Store(uint64(i))
+			return
+		}
+	}
+}
+
+// SmoothWeightedStrategy is the nginx smooth weighted round-robin. Every pick raises each peer's
+// current weight by its configured weight, chooses the peer with the highest current weight and
+// then lowers the chosen peer by the total weight. Over a full cycle every address is picked
+// exactly weight times, and heavier addresses are interleaved with lighter ones instead of bursting.
+type SmoothWeightedStrategy struct {
+	mu    sync.Mutex
+	peers []swrrPeer
+	total int
+}
+
+type swrrPeer struct {
+	AddrWeight
+	current int
+}
+
+func NewSmoothWeightedStrategy(addrWeights []AddrWeight) *SmoothWeightedStrategy {
+	s := &SmoothWeightedStrategy{peers: make([]swrrPeer, len(addrWeights))}
+	for i, aw := range addrWeights {
+		s.peers[i] = swrrPeer{AddrWeight: aw}
+		s.total += aw.Weight
+	}
+	return s
+}
+
+func (s *SmoothWeightedStrategy) Pick(*http.Request) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.peers) == 0 {
+		return ""
+	}
+	best := -1
+	for i := range s.peers {
+		s.peers[i].current += s.peers[i].Weight
+		if best == -1 || s.peers[i].current > s.peers[best].current {
+			best = i
+		}
+	}
+	s.peers[best].current -= s.total
+	return s.peers[best].Addr
+}
+
+func (s *SmoothWeightedStrategy) Done(string) {}
+
+// carry keeps the current weight of every address that was already a peer
+func (s *SmoothWeightedStrategy) carry(prev LoadbalanceStrategy) {
+	p, ok := prev.(*SmoothWeightedStrategy)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range s.peers {
+		for _, peer := range p.peers {
+			if peer.Addr == s.peers[i].Addr {
+				s.peers[i].current = peer.current
+			}
+		}
+	}
+}
+
+// inflight keeps a live count of the requests that are currently being served by each address
+type inflight struct {
+	addrs  []string
+	counts []*atomic.Int64
+	index  map[string]int
+}
+
+func newInflight(addrs []string) inflight {
+	in := inflight{
+		addrs:  addrs,
+		counts: make([]*atomic.Int64, len(addrs)),
+		index:  make(map[string]int, len(addrs)),
+	}
+	for i, addr := range addrs {
+		in.counts[i] = new(atomic.Int64)
+		in.index[addr] = i
+	}
+	return in
+}
+
+// carry shares the counts of the addresses the previous strategy had too. Requests picked from the
+// previous strategy are reported Done to it, which then lowers the shared count.
+func (in *inflight) carry(prev LoadbalanceStrategy) {
+	var p *inflight
+	switch s := prev.(type) {
+	case *LeastRequestStrategy:
+		p = &s.inflight
+	case *P2CStrategy:
+		p = &s.inflight
+	default:
+		return
+	}
+	for addr, i := range in.index {
+		if j, ok := p.index[addr]; ok {
+			in.counts[i] = p.counts[j]
+		}
+	}
+}
+
+func (in *inflight) track(addr string) {
+	if i, ok := in.index[addr]; ok {
+		in.counts[i].Add(1)
+	}
+}
+
+func (in *inflight) Done(addr string) {
+	if i, ok := in.index[addr]; ok {
+		in.counts[i].Add(-1)
+	}
+}
+
+// LeastRequestStrategy sends each request to the address with the fewest in-flight requests.
+// Ties are broken by starting the scan at a random offset so that idle upstreams share the load.
+type LeastRequestStrategy struct {
+	inflight
+}
+
+func NewLeastRequestStrategy(addrs []string) *LeastRequestStrategy {
+	return &LeastRequestStrategy{newInflight(addrs)}
+}
+
+func (s *LeastRequestStrategy) Pick(*http.Request) string {
+	n := len(s.addrs)
+	if n == 0 {
+		return ""
+	}
+	offset := rand.Intn(n)
+	best := offset
+	for j := 1; j < n; j++ {
+		i := (offset + j) % n
+		if s.counts[i].Load() < s.counts[best].Load() {
+			best = i
+		}
+	}
+	s.counts[best].Add(1)
+	return s.addrs[best]
+}
+
+// P2CStrategy (power of two choices) samples two distinct addresses at random and sends the request
+// to the one with fewer in-flight requests. It avoids the herding a full least-request scan can cause
+// while staying O(1) per pick.
+type P2CStrategy struct {
+	inflight
+}
+
+func NewP2CStrategy(addrs []string) *P2CStrategy {
+	return &P2CStrategy{newInflight(addrs)}
+}
+
+func (s *P2CStrategy) Pick(*http.Request) string {
+	n := len(s.addrs)
+	if n == 0 {
+		return ""
+	}
+	best := rand.Intn(n)
+	if n > 1 {
+		// Pick a second index that is guaranteed to be different from the first
+		other := (best + 1 + rand.Intn(n-1)) % n
+		if s.counts[other].Load() < s.counts[best].Load() {
+			best = other
+		}
+	}
+	s.counts[best].Add(1)
+	return s.addrs[best]
+}
@@ -0,0 +1,210 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+// pickConcurrently calls Pick n times spread over the given number of goroutines and counts the results
+func pickConcurrently(s LoadbalanceStrategy, goroutines, n int) map[string]int {
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		counts = make(map[string]int)
+	)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			local := make(map[string]int)
+			for i := 0; i < n/goroutines; i++ {
+				local[s.Pick(nil)]++
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for k, v := range local {
+				counts[k] += v
+			}
+		}()
+	}
+	wg.Wait()
+	return counts
+}
+
+func TestRoundRobinStrategy(t *testing.T) {
+	t.Run("picks addresses in order", func(t *testing.T) {
+		s := NewRoundRobinStrategy([]string{"a:1", "b:1", "c:1"})
+		expected := []string{"a:1", "b:1", "c:1", "a:1", "b:1", "c:1"}
+		for i, want := range expected {
+			if got := s.Pick(nil); got != want {
+				t.Errorf("pick %d: expected %q, got %q", i, want, got)
+			}
+		}
+	})
+
+	t.Run("distributes evenly under concurrent picks", func(t *testing.T) {
+		addrs := []string{"a:1", "b:1", "c:1", "d:1"}
+		s := NewRoundRobinStrategy(addrs)
+		counts := pickConcurrently(s, 16, 16*1000)
+		for _, addr := range addrs {
+			if counts[addr] != 4000 {
+				t.Errorf("expected %q to be picked 4000 times, got %d", addr, counts[addr])
+			}
+		}
+	})
+}
+
+func TestSmoothWeightedStrategy(t *testing.T) {
+	t.Run("interleaves picks like nginx", func(t *testing.T) {
+		s := NewSmoothWeightedStrategy([]AddrWeight{
+			{Addr: "a:1", Weight: 5},
+			{Addr: "b:1", Weight: 1},
+			{Addr: "c:1", Weight: 1},
+		})
+		expected := []string{"a:1", "a:1", "b:1", "a:1", "c:1", "a:1", "a:1"}
+		for i, want := range expected {
+			if got := s.Pick(nil); got != want {
+				t.Errorf("pick %d: expected %q, got %q", i, want, got)
+			}
+		}
+	})
+
+	t.Run("distributes by weight under concurrent picks", func(t *testing.T) {
+		weights := []AddrWeight{
+			{Addr: "a:1", Weight: 1},
+			{Addr: "b:1", Weight: 2},
+			{Addr: "c:1", Weight: 5},
+		}
+		s := NewSmoothWeightedStrategy(weights)
+		// Every full cycle is 8 picks, so 8000 picks is exactly 1000 cycles
+		counts := pickConcurrently(s, 8, 8000)
+		for _, aw := range weights {
+			if want := aw.Weight * 1000; counts[aw.Addr] != want {
+				t.Errorf("expected %q to be picked %d times, got %d", aw.Addr, want, counts[aw.Addr])
+			}
+		}
+	})
+}
+
+func TestRandomWeightStrategy(t *testing.T) {
+	s := RandomWeightStrategy{[]AddrWeight{
+		{Addr: "a:1", Weight: 1},
+		{Addr: "b:1", Weight: 0},
+		{Addr: "c:1", Weight: 3},
+	}}
+	counts := pickConcurrently(s, 4, 40000)
+	if counts["b:1"] != 0 {
+		t.Errorf("expected zero weight address to never be picked, got %d", counts["b:1"])
+	}
+	// Expect roughly 1:3, with plenty of slack for randomness
+	if counts["a:1"] < 8000 || counts["a:1"] > 12000 {
+		t.Errorf("expected %q to be picked roughly 10000 times, got %d", "a:1", counts["a:1"])
+	}
+}
+
+func TestRandomWeightStrategyWithoutWeights(t *testing.T) {
+	s := RandomWeightStrategy{[]AddrWeight{{Addr: "a:1", Weight: 0}, {Addr: "b:1", Weight: 0}}}
+	counts := pickConcurrently(s, 1, 100)
+	if counts["a:1"]+counts["b:1"] != 100 {
+		t.Errorf("expected every pick to be one of the addresses, got %v", counts)
+	}
+}
+
+func TestStrategiesWithoutAddresses(t *testing.T) {
+	for _, strategy := range []string{"random", "weighted", "round-robin", "weighted-round-robin", "least-request", "p2c", "hash"} {
+		t.Run(strategy, func(t *testing.T) {
+			s := compileRoutingStrategy(schema.Sink{Strategy: ptr.To(strategy)})
+			if got := s.Pick(httptest.NewRequest(http.MethodGet, "/", nil)); got != "" {
+				t.Errorf("expected no address, got %q", got)
+			}
+		})
+	}
+}
+
+func TestLeastRequestStrategy(t *testing.T) {
+	t.Run("avoids addresses with in-flight requests", func(t *testing.T) {
+		s := NewLeastRequestStrategy([]string{"a:1", "b:1", "c:1"})
+		first, second := s.Pick(nil), s.Pick(nil)
+		if first == second {
+			t.Fatalf("expected two different addresses while both are in-flight, got %q twice", first)
+		}
+		third := s.Pick(nil)
+		if third == first || third == second {
+			t.Fatalf("expected the idle address to be picked, got %q", third)
+		}
+		// Once the first request completes its address is the only idle one
+		s.Done(first)
+		if got := s.Pick(nil); got != first {
+			t.Errorf("expected %q after it completed, got %q", first, got)
+		}
+	})
+
+	t.Run("in-flight counts settle to zero under concurrent picks", func(t *testing.T) {
+		addrs := []string{"a:1", "b:1", "c:1", "d:1"}
+		s := NewLeastRequestStrategy(addrs)
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 1000; i++ {
+					s.Done(s.Pick(nil))
+				}
+			}()
+		}
+		wg.Wait()
+		for i := range s.counts {
+			if n := s.counts[i].Load(); n != 0 {
+				t.Errorf("expected no in-flight requests for %q once all completed, got %d", addrs[i], n)
+			}
+		}
+	})
+}
+
+func TestP2CStrategy(t *testing.T) {
+	t.Run("prefers the less loaded of two addresses", func(t *testing.T) {
+		s := NewP2CStrategy([]string{"a:1", "b:1"})
+		busy := s.Pick(nil)
+		for i := 0; i < 100; i++ {
+			got := s.Pick(nil)
+			if got == busy {
+				t.Fatalf("pick %d: expected the idle address, got busy address %q", i, got)
+			}
+			s.Done(got)
+		}
+	})
+
+	t.Run("single address is always picked", func(t *testing.T) {
+		s := NewP2CStrategy([]string{"a:1"})
+		if got := s.Pick(nil); got != "a:1" {
+			t.Errorf("expected %q, got %q", "a:1", got)
+		}
+	})
+}
+
+func TestCompileRoutingStrategyDetectsWeights(t *testing.T) {
+	one := 1
+	t.Run("every upstream weighted", func(t *testing.T) {
+		sink := schema.Sink{Upstreams: []schema.Upstream{
+			{Address: "127.0.0.1", Port: 1, Weight: &one},
+			{Address: "127.0.0.1", Port: 2, Weight: &one},
+		}}
+		if _, ok := compileRoutingStrategy(sink).(RandomWeightStrategy); !ok {
+			t.Errorf("expected a weighted strategy, got %T", compileRoutingStrategy(sink))
+		}
+	})
+	t.Run("some upstreams weighted", func(t *testing.T) {
+		sink := schema.Sink{Upstreams: []schema.Upstream{
+			{Address: "127.0.0.1", Port: 1, Weight: &one},
+			{Address: "127.0.0.1", Port: 2},
+		}}
+		if _, ok := compileRoutingStrategy(sink).(RandomStrategy); !ok {
+			t.Errorf("expected a random strategy, got %T", compileRoutingStrategy(sink))
+		}
+	})
+}
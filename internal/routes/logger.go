@@ -1,38 +1,140 @@
 package routes
 
 import (
+	"context"
+	"io"
 	"net/http"
 	"time"
 
-	"github.com/rs/zerolog/log"
+	"github.com/maxcelant/jap/internal/accesslog"
 )
 
 type responseRecorder struct {
 	http.ResponseWriter
-	statusCode int
+	statusCode  int
+	wroteHeader bool
+	bytes       int64
 }
 
 func (rr *responseRecorder) WriteHeader(code int) {
-	rr.statusCode = code
+	rr.statusCode, rr.wroteHeader = code, true
 	rr.ResponseWriter.WriteHeader(code)
 }
 
-var loggerRoute Middleware = func(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.wroteHeader = true
+	n, err := rr.ResponseWriter.Write(b)
+	rr.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to flush streamed responses
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// countingBody counts the bytes of the request body that were read
+type countingBody struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	return n, err
+}
 
-		rr := &responseRecorder{
-			ResponseWriter: w,
-			statusCode:     http.StatusOK,
-		}
+// requestInfo is filled in while a request is handled, for the access log to pick up afterwards
+type requestInfo struct {
+	app             string
+	route           string
+	sink            string
+	logPercent      float64
+	upstream        string
+	upstreamLatency time.Duration
+}
+
+type requestInfoKey struct{}
+
+// requestInfoFrom returns the info of the request, or nil outside of the access log middleware
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
 
-		next.ServeHTTP(rr, r)
+// observe records the metrics of every request and writes its access log line once it is done. Without
+// a logger the line goes to the regular log. Routes can sample their lines or turn them off. Requests
+// whose connection was dropped before a response was started are recorded with status 0.
+func observe(app string, l *accesslog.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			rr := &responseRecorder{
+				ResponseWriter: w,
+				statusCode:     http.StatusOK,
+			}
+			var body *countingBody
+			if r.Body != nil && r.Body != http.NoBody {
+				body = &countingBody{ReadCloser: r.Body}
+				r.Body = body
+			}
+			info := &requestInfo{app: app, logPercent: 100}
+			r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+
+			// Handlers drop the connection by panicking with http.ErrAbortHandler, the request is recorded
+			// on the way out all the same
+			aborted := true
+			defer func() {
+				status := rr.statusCode
+				if aborted && !rr.wroteHeader {
+					status = 0
+				}
+				finish(l, r, rr, body, info, status, start)
+			}()
+			next.ServeHTTP(rr, r)
+			aborted = false
+		})
+	}
+}
 
-		log.Info().
+// finish records the metrics of the request and writes its access log line
+func finish(l *accesslog.Logger, r *http.Request, rr *responseRecorder, body *countingBody, info *requestInfo, status int, start time.Time) {
+	duration := time.Since(start)
+	recordRequest(info, status, duration)
+	if !sampled(info.logPercent) {
+		return
+	}
+	if l == nil {
+		logger(r.Context()).Info().
 			Str("method", r.Method).
 			Str("path", r.URL.Path).
-			Int("status", rr.statusCode).
-			Dur("duration", time.Since(start)).
+			Int("status", status).
+			Dur("duration", duration).
 			Msg("request completed")
-	})
+		return
+	}
+	e := &accesslog.Entry{
+		Time:            start,
+		RequestID:       r.Header.Get(requestIDHeader),
+		ClientIP:        clientIP(r),
+		Method:          r.Method,
+		Path:            r.URL.Path,
+		Query:           r.URL.RawQuery,
+		Protocol:        r.Proto,
+		Host:            r.Host,
+		Status:          status,
+		BytesOut:        rr.bytes,
+		UserAgent:       r.UserAgent(),
+		Referer:         r.Referer(),
+		Route:           info.route,
+		Upstream:        info.upstream,
+		UpstreamLatency: info.upstreamLatency,
+		Duration:        duration,
+	}
+	if body != nil {
+		e.BytesIn = body.bytes
+	}
+	l.Log(e)
 }
@@ -0,0 +1,70 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+func TestAccessLog(t *testing.T) {
+	backend := testUpstream(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("hello")) })
+	path := filepath.Join(t.TempDir(), "access.log")
+	h, err := Compile(schema.App{
+		Name:      "app",
+		AccessLog: &schema.AccessLog{Path: ptr.To(path)},
+		Routes: []schema.Route{
+			{Name: "orders", Path: "/orders", Sink: "backend"},
+			{Path: "/healthz", DirectResponse: &schema.DirectResponse{Status: 200}, AccessLog: &schema.RouteAccessLog{Disabled: true}},
+			{Path: "/sampled", DirectResponse: &schema.DirectResponse{Status: 200}, AccessLog: &schema.RouteAccessLog{Percent: ptr.To(0.0)}},
+		},
+		Sinks: []schema.Sink{{Name: "backend", Upstreams: []schema.Upstream{backend}}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	for _, path := range []string{"/healthz", "/sampled", "/orders"} {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader("payload"))
+		r.Header.Set("User-Agent", "test")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the access log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected only the orders request to be logged, got %d lines: %q", len(lines), lines)
+	}
+	var got map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatalf("expected a JSON line: %v", err)
+	}
+	expected := map[string]any{
+		"route":      "orders",
+		"path":       "/orders",
+		"status":     float64(200),
+		"bytes_in":   float64(len("payload")),
+		"bytes_out":  float64(len("hello")),
+		"user_agent": "test",
+		"upstream":   upstreamAddrs([]schema.Upstream{backend})[0],
+	}
+	for key, want := range expected {
+		if got[key] != want {
+			t.Errorf("expected %s to be %v, got %v", key, want, got[key])
+		}
+	}
+	if id, _ := got["request_id"].(string); id == "" {
+		t.Errorf("expected the line to carry the request id")
+	}
+	if latency, _ := got["upstream_latency_ms"].(float64); latency <= 0 || latency > got["duration_ms"].(float64) {
+		t.Errorf("expected an upstream latency within the total duration, got %v of %v", got["upstream_latency_ms"], got["duration_ms"])
+	}
+}
@@ -6,9 +6,10 @@ import (
 	"strings"
 )
 
+// MatcherList holds the conditions of a route besides its path, which the route table takes care of
 type MatcherList []Matcher
 
-func (ml MatcherList) Match(r http.Request) bool {
+func (ml MatcherList) Match(r *http.Request) bool {
 	for _, m := range ml {
 		if !m.Match(r) {
 			return false
@@ -18,46 +19,94 @@ func (ml MatcherList) Match(r http.Request) bool {
 }
 
 type Matcher interface {
-	Match(http.Request) bool
+	Match(*http.Request) bool
 }
 
-// PathMatcher matches exact paths
-type PathMatcher struct {
-	Path string
-}
-
-func (p PathMatcher) Match(r http.Request) bool {
-	return r.URL.Path == p.Path
+// MethodMatcher matches HTTP methods
+type MethodMatcher struct {
+	Methods []string
 }
 
-// PrefixMatcher matches paths that start with the given prefix
-type PrefixMatcher struct {
-	Prefix string
+func (m MethodMatcher) Match(r *http.Request) bool {
+	for _, method := range m.Methods {
+		if strings.EqualFold(r.Method, method) {
+			return true
+		}
+	}
+	return false
 }
 
-func (p PrefixMatcher) Match(r http.Request) bool {
-	return strings.HasPrefix(r.URL.Path, p.Prefix)
+// HeaderMatcher matches a request header against exactly one of its conditions. A header that is sent
+// multiple times matches if any of its values does. Invert flips the outcome.
+type HeaderMatcher struct {
+	Name    string
+	Exact   *string
+	Prefix  *string
+	Regex   *regexp.Regexp
+	Present *bool
+	Invert  bool
 }
 
-// RegexMatcher matches paths against a regular expression
-type RegexMatcher struct {
-	Pattern *regexp.Regexp
+func (h HeaderMatcher) Match(r *http.Request) bool {
+	return h.match(r.Header.Values(h.Name)) != h.Invert
 }
 
-func (r RegexMatcher) Match(req http.Request) bool {
-	return r.Pattern.MatchString(req.URL.Path)
+func (h HeaderMatcher) match(values []string) bool {
+	if h.Present != nil {
+		return (len(values) > 0) == *h.Present
+	}
+	for _, v := range values {
+		switch {
+		case h.Exact != nil && v == *h.Exact:
+			return true
+		case h.Prefix != nil && strings.HasPrefix(v, *h.Prefix):
+			return true
+		case h.Regex != nil && h.Regex.MatchString(v):
+			return true
+		}
+	}
+	return false
 }
 
-// MethodMatcher matches HTTP methods
-type MethodMatcher struct {
-	Methods []string
+// valueMatch is the condition shared by the query parameter and cookie matchers, only one field is set
+type valueMatch struct {
+	Exact   *string
+	Regex   *regexp.Regexp
+	Present *bool
 }
 
-func (m MethodMatcher) Match(r http.Request) bool {
-	for _, method := range m.Methods {
-		if strings.EqualFold(r.Method, method) {
+func (m valueMatch) match(values []string) bool {
+	if m.Present != nil {
+		return (len(values) > 0) == *m.Present
+	}
+	for _, v := range values {
+		if (m.Exact != nil && v == *m.Exact) || (m.Regex != nil && m.Regex.MatchString(v)) {
 			return true
 		}
 	}
 	return false
 }
+
+// QueryMatcher matches a query parameter. A parameter that is sent multiple times matches if any of its values does.
+type QueryMatcher struct {
+	Name string
+	valueMatch
+}
+
+func (q QueryMatcher) Match(r *http.Request) bool {
+	return q.match(r.URL.Query()[q.Name])
+}
+
+// CookieMatcher matches a request cookie. A cookie that is sent multiple times matches if any of its values does.
+type CookieMatcher struct {
+	Name string
+	valueMatch
+}
+
+func (c CookieMatcher) Match(r *http.Request) bool {
+	var values []string
+	for _, cookie := range r.CookiesNamed(c.Name) {
+		values = append(values, cookie.Value)
+	}
+	return c.match(values)
+}
@@ -0,0 +1,169 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+func TestHeaderMatcher(t *testing.T) {
+	tests := []struct {
+		name     string
+		matcher  HeaderMatcher
+		headers  map[string][]string
+		expected bool
+	}{
+		{
+			name:     "exact match",
+			matcher:  HeaderMatcher{Name: "x-canary", Exact: ptr.To("true")},
+			headers:  map[string][]string{"X-Canary": {"true"}},
+			expected: true,
+		},
+		{
+			name:     "exact mismatch",
+			matcher:  HeaderMatcher{Name: "x-canary", Exact: ptr.To("true")},
+			headers:  map[string][]string{"X-Canary": {"false"}},
+			expected: false,
+		},
+		{
+			name:     "any value of a repeated header can match",
+			matcher:  HeaderMatcher{Name: "x-canary", Exact: ptr.To("true")},
+			headers:  map[string][]string{"X-Canary": {"false", "true"}},
+			expected: true,
+		},
+		{
+			name:     "prefix match",
+			matcher:  HeaderMatcher{Name: "accept", Prefix: ptr.To("application/vnd.api.v2")},
+			headers:  map[string][]string{"Accept": {"application/vnd.api.v2+json"}},
+			expected: true,
+		},
+		{
+			name:     "regex match",
+			matcher:  HeaderMatcher{Name: "x-api-version", Regex: regexp.MustCompile(`^v[23]$`)},
+			headers:  map[string][]string{"X-Api-Version": {"v3"}},
+			expected: true,
+		},
+		{
+			name:     "present",
+			matcher:  HeaderMatcher{Name: "authorization", Present: ptr.To(true)},
+			headers:  map[string][]string{"Authorization": {"Bearer x"}},
+			expected: true,
+		},
+		{
+			name:     "absent",
+			matcher:  HeaderMatcher{Name: "authorization", Present: ptr.To(false)},
+			headers:  map[string][]string{},
+			expected: true,
+		},
+		{
+			name:     "absent header does not match a value",
+			matcher:  HeaderMatcher{Name: "x-canary", Exact: ptr.To("true")},
+			headers:  map[string][]string{},
+			expected: false,
+		},
+		{
+			name:     "inverted match",
+			matcher:  HeaderMatcher{Name: "x-canary", Exact: ptr.To("true"), Invert: true},
+			headers:  map[string][]string{"X-Canary": {"true"}},
+			expected: false,
+		},
+		{
+			name:     "inverted mismatch",
+			matcher:  HeaderMatcher{Name: "x-canary", Exact: ptr.To("true"), Invert: true},
+			headers:  map[string][]string{},
+			expected: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header = tt.headers
+			if got := tt.matcher.Match(r); got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestCompileHeaderRouting(t *testing.T) {
+	canary := testUpstream(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("canary")) })
+	stable := testUpstream(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("stable")) })
+	h, err := Compile(schema.App{
+		Name: "app",
+		Routes: []schema.Route{
+			{
+				Path:    "/api",
+				Match:   ptr.To("prefix"),
+				Headers: []schema.HeaderMatch{{Name: "x-canary", Exact: ptr.To("true")}},
+				Sink:    "canary",
+			},
+			{Path: "/api", Match: ptr.To("prefix"), Sink: "stable"},
+		},
+		Sinks: []schema.Sink{
+			{Name: "canary", Upstreams: []schema.Upstream{canary}},
+			{Name: "stable", Upstreams: []schema.Upstream{stable}},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		canary   string
+		expected string
+	}{
+		{name: "canary header goes to the canary sink", path: "/api/users", canary: "true", expected: "canary"},
+		{name: "other header values fall through", path: "/api/users", canary: "false", expected: "stable"},
+		{name: "missing header falls through", path: "/api/users", expected: "stable"},
+		{name: "unmatched path reaches no sink", path: "/other", canary: "true", expected: "No matching route found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.canary != "" {
+				r.Header.Set("x-canary", tt.canary)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Body.String() != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestQueryAndCookieMatchers(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/checkout?beta=1&variant=b2&variant=c", nil)
+	r.AddCookie(&http.Cookie{Name: "beta", Value: "yes"})
+
+	tests := []struct {
+		name     string
+		matcher  Matcher
+		expected bool
+	}{
+		{name: "query exact", matcher: QueryMatcher{"beta", valueMatch{Exact: ptr.To("1")}}, expected: true},
+		{name: "query exact mismatch", matcher: QueryMatcher{"beta", valueMatch{Exact: ptr.To("0")}}, expected: false},
+		{name: "query regex on repeated param", matcher: QueryMatcher{"variant", valueMatch{Regex: regexp.MustCompile(`^c$`)}}, expected: true},
+		{name: "query present", matcher: QueryMatcher{"beta", valueMatch{Present: ptr.To(true)}}, expected: true},
+		{name: "query absent", matcher: QueryMatcher{"debug", valueMatch{Present: ptr.To(false)}}, expected: true},
+		{name: "cookie exact", matcher: CookieMatcher{"beta", valueMatch{Exact: ptr.To("yes")}}, expected: true},
+		{name: "cookie regex mismatch", matcher: CookieMatcher{"beta", valueMatch{Regex: regexp.MustCompile(`^no`)}}, expected: false},
+		{name: "cookie present", matcher: CookieMatcher{"beta", valueMatch{Present: ptr.To(true)}}, expected: true},
+		{name: "missing cookie is absent", matcher: CookieMatcher{"session", valueMatch{Present: ptr.To(false)}}, expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.matcher.Match(r); got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
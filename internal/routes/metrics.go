@@ -0,0 +1,70 @@
+package routes
+
+import (
+	"cmp"
+	"strconv"
+	"time"
+
+	"github.com/maxcelant/jap/internal/metrics"
+	"github.com/maxcelant/jap/internal/schema"
+)
+
+// The route label is empty for requests that matched no route, the sink and upstream labels are empty
+// for requests that were not proxied
+var (
+	requestsTotal = metrics.Default.Counter("jap_requests_total",
+		"Requests handled, by the route, sink and upstream that served them and the response status.",
+		"app", "route", "sink", "upstream", "code")
+	requestDuration = metrics.Default.Histogram("jap_request_duration_seconds",
+		"Time until the response was written to the client.",
+		metrics.DefaultBuckets, "app", "route", "sink", "upstream")
+	requestsInFlight = metrics.Default.Gauge("jap_requests_in_flight",
+		"Requests currently being handled by a route.",
+		"app", "route")
+	upstreamDuration = metrics.Default.Histogram("jap_upstream_request_duration_seconds",
+		"Time until the upstream sent its response headers, for every attempt including retries.",
+		metrics.DefaultBuckets, "app", "route", "sink", "upstream")
+	upstreamInFlight = metrics.Default.Gauge("jap_upstream_requests_in_flight",
+		"Requests currently sent to an upstream.",
+		"app", "route", "sink", "upstream")
+)
+
+// recordRequest counts the request once its response is written
+func recordRequest(info *requestInfo, status int, duration time.Duration) {
+	requestsTotal.With(info.app, info.route, info.sink, info.upstream, strconv.Itoa(status)).Inc()
+	requestDuration.With(info.app, info.route, info.sink, info.upstream).Observe(duration.Seconds())
+}
+
+// pruneMetrics deletes the series of the routes, sinks and upstreams the app no longer has. An app
+// without routes is one that was removed, so all of its series are deleted.
+func pruneMetrics(app schema.App) {
+	routes := make(map[string]bool, len(app.Routes)+1)
+	if len(app.Routes) > 0 {
+		routes[""] = true
+	}
+	for _, r := range app.Routes {
+		routes[cmp.Or(r.Name, r.Path)] = true
+	}
+	// Keyed by sink and upstream, requests that were not proxied or found no upstream have them empty
+	upstreams := map[[2]string]bool{{"", ""}: true}
+	for _, s := range app.Sinks {
+		upstreams[[2]string{s.Name, ""}] = true
+		for _, addr := range upstreamAddrs(s.Upstreams) {
+			upstreams[[2]string{s.Name, addr}] = true
+		}
+	}
+	stale := func(values []string) bool {
+		if values[0] != app.Name {
+			return false
+		}
+		if !routes[values[1]] {
+			return true
+		}
+		return len(values) > 3 && !upstreams[[2]string{values[2], values[3]}]
+	}
+	requestsTotal.DeleteFunc(stale)
+	requestDuration.DeleteFunc(stale)
+	requestsInFlight.DeleteFunc(stale)
+	upstreamDuration.DeleteFunc(stale)
+	upstreamInFlight.DeleteFunc(stale)
+}
@@ -0,0 +1,122 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maxcelant/jap/internal/metrics"
+	"github.com/maxcelant/jap/internal/schema"
+)
+
+func TestRequestMetrics(t *testing.T) {
+	backend := testUpstream(t, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusCreated) })
+	h, err := Compile(schema.App{
+		Name: "metrics-app",
+		Routes: []schema.Route{
+			{Name: "orders", Path: "/orders", Sink: "backend"},
+			{Name: "static", Path: "/static", DirectResponse: &schema.DirectResponse{Status: http.StatusTeapot}},
+			{Name: "reset", Path: "/reset", Sink: "backend", Faults: &schema.Faults{Abort: &schema.FaultAbort{Reset: true}}},
+		},
+		Sinks: []schema.Sink{{Name: "backend", Upstreams: []schema.Upstream{backend}}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	for _, path := range []string{"/orders", "/orders", "/static", "/missing"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	// The server recovers the panic of a dropped connection, it has to reach it unchanged
+	func() {
+		defer func() {
+			if p := recover(); p != http.ErrAbortHandler {
+				t.Errorf("expected the abort to reach the server, got %v", p)
+			}
+		}()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/reset", nil))
+	}()
+
+	upstream := upstreamAddrs([]schema.Upstream{backend})[0]
+	tests := []struct {
+		name   string
+		labels []string
+		count  float64
+	}{
+		{"proxied", []string{"metrics-app", "orders", "backend", upstream, "201"}, 2},
+		{"direct response", []string{"metrics-app", "static", "", "", "418"}, 1},
+		{"no route", []string{"metrics-app", "", "", "", "200"}, 1},
+		{"dropped connection", []string{"metrics-app", "reset", "", "", "0"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := requestsTotal.With(tt.labels...).Value(); got != tt.count {
+				t.Errorf("expected %v requests, got %v", tt.count, got)
+			}
+		})
+	}
+	if got := requestsInFlight.With("metrics-app", "orders").Value(); got != 0 {
+		t.Errorf("expected no requests in flight, got %v", got)
+	}
+	if got := upstreamInFlight.With("metrics-app", "orders", "backend", upstream).Value(); got != 0 {
+		t.Errorf("expected no upstream requests in flight, got %v", got)
+	}
+}
+
+func TestPruneMetrics(t *testing.T) {
+	app := schema.App{
+		Name:   "prune-app",
+		Routes: []schema.Route{{Name: "orders", Path: "/orders", Sink: "backend"}},
+		Sinks: []schema.Sink{{Name: "backend", Upstreams: []schema.Upstream{
+			{Address: "127.0.0.1", Port: 8080},
+			{Address: "127.0.0.1", Port: 8081},
+		}}},
+	}
+	upstreamInFlight.With("prune-app", "orders", "backend", "127.0.0.1:8080").Inc()
+	upstreamInFlight.With("prune-app", "orders", "backend", "127.0.0.1:8081").Inc()
+	upstreamInFlight.With("prune-app", "legacy", "backend", "127.0.0.1:8080").Inc()
+	upstreamInFlight.With("other-app", "legacy", "backend", "127.0.0.1:8081").Inc()
+	requestsInFlight.With("prune-app", "").Inc()
+	requestsInFlight.With("prune-app", "legacy").Inc()
+
+	registry := NewEndpointRegistry()
+	app.Sinks[0].Upstreams = app.Sinks[0].Upstreams[:1]
+	registry.Prune(app)
+	tests := []struct {
+		series   string
+		exported bool
+	}{
+		{`jap_upstream_requests_in_flight{app="prune-app",route="orders",sink="backend",upstream="127.0.0.1:8080"}`, true},
+		{`jap_upstream_requests_in_flight{app="prune-app",route="orders",sink="backend",upstream="127.0.0.1:8081"}`, false},
+		{`jap_upstream_requests_in_flight{app="prune-app",route="legacy",sink="backend",upstream="127.0.0.1:8080"}`, false},
+		{`jap_upstream_requests_in_flight{app="other-app",route="legacy",sink="backend",upstream="127.0.0.1:8081"}`, true},
+		{`jap_requests_in_flight{app="prune-app",route=""}`, true},
+		{`jap_requests_in_flight{app="prune-app",route="legacy"}`, false},
+	}
+	out := scrape(t)
+	for _, tt := range tests {
+		if strings.Contains(out, tt.series+" ") != tt.exported {
+			t.Errorf("expected %s to be exported: %v", tt.series, tt.exported)
+		}
+	}
+
+	t.Run("a removed app loses all of its series", func(t *testing.T) {
+		registry.Prune(schema.App{Name: "prune-app"})
+		out := scrape(t)
+		if strings.Contains(out, `app="prune-app"`) {
+			t.Errorf("expected every series of the app to be deleted")
+		}
+		if !strings.Contains(out, `app="other-app"`) {
+			t.Errorf("expected the series of the other app to be kept")
+		}
+	})
+}
+
+func scrape(t *testing.T) string {
+	t.Helper()
+	var buf strings.Builder
+	if _, err := metrics.Default.WriteTo(&buf); err != nil {
+		t.Fatalf("failed to write metrics: %v", err)
+	}
+	return buf.String()
+}
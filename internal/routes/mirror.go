@@ -0,0 +1,111 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	defaultMirrorPercent     = 100
+	defaultMirrorBufferLimit = 64 << 10
+	// defaultMirrorTimeout bounds mirrored requests of routes without a timeout, so that a stuck shadow
+	// sink cannot pile up requests forever
+	defaultMirrorTimeout = 30 * time.Second
+	// maxMirroredRequests caps the copies in flight across every route, as each of them may hold on to
+	// a buffered body until its timeout
+	maxMirroredRequests = 512
+)
+
+// mirrorSlots is taken by every copy in flight, copies that find no free slot are dropped
+var mirrorSlots = make(chan struct{}, maxMirroredRequests)
+
+// Mirror sends a copy of a share of the requests of a route to another sink. The copies are sent in the
+// background and their responses are thrown away, so they never hold up the client. Once too many copies
+// are in flight, further ones are dropped rather than queued.
+type Mirror struct {
+	Sink        *Sink
+	Percent     float64
+	BufferLimit int64
+}
+
+func compileMirror(m *schema.Mirror, sinks map[string]*Sink) *Mirror {
+	if m == nil {
+		return nil
+	}
+	return &Mirror{
+		Sink:        sinks[m.Sink],
+		Percent:     ptr.Deref(m.Percent, defaultMirrorPercent),
+		BufferLimit: ptr.Deref(m.BufferLimitBytes, defaultMirrorBufferLimit),
+	}
+}
+
+// mirror sends the copy of the request if it is sampled. The body is buffered first, and the request is
+// left with a fresh reader over that buffer so that it can still be proxied as usual.
+func (h Handler) mirror(r *http.Request) {
+	m := h.Mirror
+	if m == nil || m.Sink == nil || !sampled(m.Percent) {
+		return
+	}
+	slots := mirrorSlots
+	select {
+	case slots <- struct{}{}:
+	default:
+		logger(r.Context()).Debug().Str("sink", m.Sink.Name).Msg("too many mirrored requests in flight, dropping copy")
+		return
+	}
+	body := []byte{}
+	if r.Body != nil && r.Body != http.NoBody {
+		buf, ok := bufferBody(r, m.BufferLimit)
+		if !ok {
+			<-slots
+			return
+		}
+		body = buf
+		r.Body = io.NopCloser(bytes.NewReader(buf))
+	}
+
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = defaultMirrorTimeout
+	}
+	// The copy must outlive the client request, which is cancelled as soon as the client has its response
+	ctx, cancelTimeout := context.WithTimeout(context.WithoutCancel(r.Context()), timeout)
+	shadow := r.Clone(ctx)
+	shadow.Body = http.NoBody
+	go func() {
+		defer func() { <-slots }()
+		defer cancelTimeout()
+		release, ok := m.Sink.Breaker.acquire(ctx)
+		if !ok {
+			return
+		}
+		defer release()
+		strategy := m.Sink.Strategy()
+		upstreamHost := strategy.Pick(shadow)
+		if upstreamHost == "" {
+			return
+		}
+		defer strategy.Done(upstreamHost)
+		// Only the settings of the route that shape the outgoing request matter, the copy is never retried
+		res, cancel, err := Handler{
+			Name:           h.Name,
+			Transport:      h.Transport,
+			Rewrite:        h.Rewrite,
+			RequestHeaders: h.RequestHeaders,
+		}.roundTrip(shadow, m.Sink, upstreamHost, body)
+		defer cancel()
+		m.Sink.Report(upstreamHost, err != nil || res.StatusCode >= http.StatusInternalServerError)
+		if err != nil {
+			logger(ctx).Debug().Err(err).Str("sink", m.Sink.Name).Msg("mirrored request failed")
+			return
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}()
+}
@@ -0,0 +1,118 @@
+package routes
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+func TestMirror(t *testing.T) {
+	type mirrored struct {
+		path, body string
+	}
+	shadowed := make(chan mirrored, 10)
+	release := make(chan struct{})
+	shadow := testUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		shadowed <- mirrored{r.URL.Path, string(body)}
+		// A slow shadow must not hold up the client
+		<-release
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer close(release)
+	primary := testUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})
+
+	compile := func(mirror *schema.Mirror) http.Handler {
+		h, err := Compile(schema.App{
+			Name:   "app",
+			Routes: []schema.Route{{Path: "/orders", Sink: "primary", Mirror: mirror}},
+			Sinks: []schema.Sink{
+				{Name: "primary", Upstreams: []schema.Upstream{primary}},
+				{Name: "shadow", Upstreams: []schema.Upstream{shadow}},
+			},
+		}, nil)
+		if err != nil {
+			t.Fatalf("failed to compile: %v", err)
+		}
+		return h
+	}
+	send := func(h http.Handler, body string) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body)))
+		return rec.Body.String()
+	}
+
+	t.Run("a copy of the request is sent to the mirror sink", func(t *testing.T) {
+		h := compile(&schema.Mirror{Sink: "shadow"})
+		done := make(chan string)
+		go func() { done <- send(h, `{"id":1}`) }()
+		select {
+		case got := <-done:
+			if got != `{"id":1}` {
+				t.Errorf("expected the primary to get the body, got %q", got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("the client waited for the mirrored request")
+		}
+		select {
+		case m := <-shadowed:
+			if m.path != "/orders" || m.body != `{"id":1}` {
+				t.Errorf("expected the mirror to get /orders with the body, got %s with %q", m.path, m.body)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("the request was not mirrored")
+		}
+	})
+
+	t.Run("bodies over the limit are not mirrored", func(t *testing.T) {
+		h := compile(&schema.Mirror{Sink: "shadow", BufferLimitBytes: ptr.To[int64](4)})
+		if got := send(h, "too large"); got != "too large" {
+			t.Errorf("expected the primary to get the whole body, got %q", got)
+		}
+		select {
+		case m := <-shadowed:
+			t.Errorf("expected no mirrored request, got %s with %q", m.path, m.body)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	t.Run("copies are dropped once too many are in flight", func(t *testing.T) {
+		defer func(slots chan struct{}) { mirrorSlots = slots }(mirrorSlots)
+		mirrorSlots = make(chan struct{}, 1)
+		h := compile(&schema.Mirror{Sink: "shadow"})
+		send(h, "first")
+		select {
+		case <-shadowed:
+		case <-time.After(time.Second):
+			t.Fatalf("the first request was not mirrored")
+		}
+		// The shadow is still holding on to the first copy, so the second has no slot
+		if got := send(h, "second"); got != "second" {
+			t.Errorf("expected the primary to get the body, got %q", got)
+		}
+		select {
+		case m := <-shadowed:
+			t.Errorf("expected no mirrored request, got %s with %q", m.path, m.body)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	t.Run("unsampled requests are not mirrored", func(t *testing.T) {
+		h := compile(&schema.Mirror{Sink: "shadow", Percent: ptr.To(0.0)})
+		send(h, "{}")
+		select {
+		case m := <-shadowed:
+			t.Errorf("expected no mirrored request, got %s with %q", m.path, m.body)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package routes
+
+import (
+	"sync"
+	"time"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	defaultConsecutiveErrors  = 5
+	defaultBaseEjectionTime   = 30 * time.Second
+	defaultMaxEjectionTime    = 5 * time.Minute
+	defaultMaxEjectionPercent = 50
+)
+
+// OutlierDetector passively watches the results of the requests a sink sends to its endpoints. An
+// endpoint that fails too many requests in a row is ejected from the sink's strategy, for a period
+// that doubles with every ejection up to a maximum. The number of endpoints out of rotation at once,
+// whether ejected or failing their health check, is capped so that a sink always keeps at least one
+// endpoint in rotation.
+type OutlierDetector struct {
+	consecutiveErrors  int
+	baseEjectionTime   time.Duration
+	maxEjectionTime    time.Duration
+	maxEjectionPercent int
+	endpoints          []*Endpoint
+
+	// mu serializes ejections so that the ejection cap cannot be overshot by concurrent failures. It is
+	// shared by every detector compiled for the sink, so that the detectors of a route table that is
+	// being replaced and of its replacement do not eject side by side.
+	mu *sync.Mutex
+}
+
+func NewOutlierDetector(cfg schema.OutlierDetection, endpoints []*Endpoint, mu *sync.Mutex) *OutlierDetector {
+	return &OutlierDetector{
+		consecutiveErrors:  ptr.Deref(cfg.ConsecutiveErrors, defaultConsecutiveErrors),
+		baseEjectionTime:   time.Duration(ptr.Deref(cfg.BaseEjectionTime, schema.Duration(defaultBaseEjectionTime))),
+		maxEjectionTime:    time.Duration(ptr.Deref(cfg.MaxEjectionTime, schema.Duration(defaultMaxEjectionTime))),
+		maxEjectionPercent: ptr.Deref(cfg.MaxEjectionPercent, defaultMaxEjectionPercent),
+		endpoints:          endpoints,
+		mu:                 mu,
+	}
+}
+
+// Report records the outcome of a single request sent to the endpoint
+func (od *OutlierDetector) Report(e *Endpoint, failed bool) {
+	if !failed {
+		e.consecutiveFailures.Store(0)
+		return
+	}
+	if e.consecutiveFailures.Add(1) < int64(od.consecutiveErrors) {
+		return
+	}
+
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	if e.ejected.Load() {
+		return
+	}
+	unavailable := 0
+	for _, ep := range od.endpoints {
+		if ep != e && !ep.Available() {
+			unavailable++
+		}
+	}
+	// Never eject the last endpoint in rotation, and stay under the configured share of the sink
+	if unavailable+1 >= len(od.endpoints) || (unavailable+1)*100 > od.maxEjectionPercent*len(od.endpoints) {
+		return
+	}
+	// An endpoint that has behaved for a full maximum ejection period starts over at the base time
+	if time.Since(e.lastEjectionEnd) > od.maxEjectionTime {
+		e.ejections = 0
+	}
+	e.ejections++
+	d := od.baseEjectionTime << (e.ejections - 1)
+	if d > od.maxEjectionTime || d <= 0 {
+		d = od.maxEjectionTime
+	}
+	e.consecutiveFailures.Store(0)
+	e.eject(d)
+}
@@ -0,0 +1,106 @@
+package routes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+func TestOutlierDetector(t *testing.T) {
+	registry := NewEndpointRegistry()
+	sink := NewSink("app", schema.Sink{
+		Name: "backend",
+		OutlierDetection: &schema.OutlierDetection{
+			ConsecutiveErrors:  ptr.To(2),
+			BaseEjectionTime:   ptr.To(schema.Duration(50 * time.Millisecond)),
+			MaxEjectionTime:    ptr.To(schema.Duration(time.Second)),
+			MaxEjectionPercent: ptr.To(50),
+		},
+		Upstreams: []schema.Upstream{
+			{Address: "127.0.0.1", Port: 8080},
+			{Address: "127.0.0.1", Port: 8081},
+			{Address: "127.0.0.1", Port: 8082},
+		},
+	}, registry)
+	a, b := sink.Endpoints[0], sink.Endpoints[1]
+
+	t.Run("successes reset the consecutive failure count", func(t *testing.T) {
+		sink.Report(a.Addr, true)
+		sink.Report(a.Addr, false)
+		sink.Report(a.Addr, true)
+		if a.Ejected() {
+			t.Errorf("expected non-consecutive failures to not eject the endpoint")
+		}
+	})
+
+	t.Run("consecutive failures eject the endpoint", func(t *testing.T) {
+		sink.Report(a.Addr, true)
+		if !a.Ejected() {
+			t.Fatalf("expected the endpoint to be ejected")
+		}
+		for i := 0; i < 10; i++ {
+			if got := sink.Strategy().Pick(nil); got == a.Addr {
+				t.Fatalf("expected the ejected endpoint to not be picked")
+			}
+		}
+	})
+
+	t.Run("ejections are capped by the max ejection percent", func(t *testing.T) {
+		sink.Report(b.Addr, true)
+		sink.Report(b.Addr, true)
+		if b.Ejected() {
+			t.Errorf("expected a second ejection to exceed 50%% of the sink")
+		}
+	})
+
+	t.Run("ejected endpoint returns and doubles its next ejection", func(t *testing.T) {
+		deadline := time.Now().Add(time.Second)
+		for a.Ejected() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for the endpoint to return")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		sink.Report(a.Addr, true)
+		sink.Report(a.Addr, true)
+		if !a.Ejected() {
+			t.Fatalf("expected the endpoint to be ejected again")
+		}
+		if remaining := time.Until(a.lastEjectionEnd); remaining <= 50*time.Millisecond {
+			t.Errorf("expected the second ejection to last longer than the base time, %v remaining", remaining)
+		}
+	})
+}
+
+func TestOutlierDetectorSharesSinkState(t *testing.T) {
+	registry := NewEndpointRegistry()
+	cfg := schema.Sink{
+		Name: "backend",
+		OutlierDetection: &schema.OutlierDetection{
+			ConsecutiveErrors:  ptr.To(1),
+			MaxEjectionPercent: ptr.To(100),
+		},
+		Upstreams: []schema.Upstream{
+			{Address: "127.0.0.1", Port: 8080},
+			{Address: "127.0.0.1", Port: 8081},
+		},
+	}
+	sink := NewSink("app", cfg, registry)
+	reloaded := NewSink("app", cfg, registry)
+
+	t.Run("detectors of a reloaded sink share their lock", func(t *testing.T) {
+		if sink.Outliers.mu != reloaded.Outliers.mu {
+			t.Errorf("expected both detectors to serialize ejections on the same lock")
+		}
+	})
+
+	t.Run("unhealthy endpoints count toward the cap", func(t *testing.T) {
+		sink.Endpoints[0].SetHealthy(false)
+		reloaded.Report(sink.Endpoints[1].Addr, true)
+		if sink.Endpoints[1].Ejected() {
+			t.Errorf("expected the last available endpoint to stay in rotation")
+		}
+	})
+}
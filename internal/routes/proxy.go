@@ -1,14 +1,24 @@
 package routes
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"io"
 	"net/http"
+	"time"
+
+	"github.com/maxcelant/jap/internal/tracing"
 )
 
-type Upstreams struct {
-	SocketAddrs []string
-	Strategy    LoadbalanceStrategy
-}
+// errUpstreamTimeout marks round trips that were cut short by the route timeout, the per-try timeout
+// or the idle timeout
+var errUpstreamTimeout = errors.New("upstream request timeout")
+
+var errIdleTimeout = errors.New("upstream idle timeout")
+
+// errNoUpstream is returned for sinks without any upstream to pick
+var errNoUpstream = errors.New("no upstream available")
 
 type Transport struct {
 	http.RoundTripper
@@ -16,23 +26,199 @@ type Transport struct {
 
 // Reverse proxying is just a handler
 type Handler struct {
-	Upstreams Upstreams
-	Matchers  MatcherList
+	Name      string // the route name, or its path when it has none
+	Sink      *Sink
+	Split     *SinkSplit // nil when the route sends to a single sink
 	Transport Transport
+	Retries   *RetryPolicy // nil when the route does not retry
+	Rewrite   *Rewrite     // nil when the route forwards the request as it is
+	Mirror    *Mirror      // nil when the route is not mirrored
+	// RequestHeaders and ResponseHeaders are nil when the route leaves the headers alone
+	RequestHeaders  *HeaderOps
+	ResponseHeaders *HeaderOps
+	// Timeout bounds the whole request including retries, IdleTimeout the time the upstream may stay silent
+	Timeout     time.Duration
+	IdleTimeout time.Duration
 }
 
 func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	upstreamHost := h.Upstreams.Strategy.Pick()
+	if h.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), h.Timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	sink := h.Sink
+	if h.Split != nil {
+		sink = h.Split.pick(r)
+	}
+	info := requestInfoFrom(r.Context())
+	var app string
+	if info != nil {
+		info.sink = sink.Name
+		app = info.app
+	}
+	release, ok := sink.Breaker.acquire(r.Context())
+	if !ok {
+		if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+			writeError(w, http.StatusGatewayTimeout, errUpstreamTimeout.Error())
+			return
+		}
+		writeOverloaded(w)
+		return
+	}
+	defer release()
+
+	h.mirror(r)
+	maxAttempts, body := h.Retries.attempts(r)
+	tried := make(map[string]bool, maxAttempts)
+	for attempt := 1; ; attempt++ {
+		strategy := sink.Strategy()
+		upstreamHost := pickUntried(sink, strategy, r, tried)
+		if upstreamHost == "" {
+			writeError(w, http.StatusServiceUnavailable, errNoUpstream.Error())
+			return
+		}
+		tried[upstreamHost] = true
+
+		inFlight := upstreamInFlight.With(app, h.Name, sink.Name, upstreamHost)
+		inFlight.Inc()
+		start := time.Now()
+		res, cancel, err := h.roundTrip(r, sink, upstreamHost, body)
+		latency := time.Since(start)
+		upstreamDuration.With(app, h.Name, sink.Name, upstreamHost).Observe(latency.Seconds())
+		if info != nil {
+			info.upstream, info.upstreamLatency = upstreamHost, latency
+		}
+		// A request the client gave up on says nothing about the upstream
+		if failed := err != nil || res.StatusCode >= http.StatusInternalServerError; !failed || r.Context().Err() == nil {
+			sink.Report(upstreamHost, failed)
+		}
+		if attempt < maxAttempts && h.Retries.shouldRetry(res, err) {
+			// Without a free retry slot the sink is struggling, so the outcome is returned as it is
+			if releaseRetry, ok := sink.Breaker.acquireRetry(); ok {
+				defer releaseRetry()
+				event := logger(r.Context()).Debug().Err(err).Str("upstream", upstreamHost).Int("attempt", attempt)
+				if res != nil {
+					event.Int("status", res.StatusCode)
+					res.Body.Close()
+				}
+				event.Msg("retrying upstream request")
+				cancel()
+				strategy.Done(upstreamHost)
+				inFlight.Dec()
+				if !h.Retries.wait(r.Context(), attempt) {
+					if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+						writeError(w, http.StatusGatewayTimeout, errUpstreamTimeout.Error())
+						return
+					}
+					writeError(w, http.StatusBadGateway, "client went away while waiting to retry")
+					return
+				}
+				continue
+			}
+		}
+
+		defer strategy.Done(upstreamHost)
+		defer inFlight.Dec()
+		defer cancel()
+		if errors.Is(err, errUpstreamTimeout) {
+			logger(r.Context()).Warn().Err(err).Str("upstream", upstreamHost).Msg("upstream request timed out")
+			writeError(w, http.StatusGatewayTimeout, errUpstreamTimeout.Error())
+			return
+		}
+		if err != nil {
+			logger(r.Context()).Warn().Err(err).Str("upstream", upstreamHost).Msg("upstream request failed")
+			writeError(w, http.StatusBadGateway, "error occurred while performing roundtrip")
+			return
+		}
+		defer res.Body.Close()
+		// The client gets the ID it is logged under, whatever the upstream made of it
+		if id := r.Header.Get(requestIDHeader); id != "" {
+			res.Header.Set(requestIDHeader, id)
+		}
+		vars := h.headerVars(r, upstreamHost)
+		sink.ResponseHeaders.apply(res.Header, vars)
+		h.ResponseHeaders.apply(res.Header, vars)
+		// Once the status is out, resetting the connection is the only way left to tell the client that
+		// the body was cut short
+		if err := writeResponse(w, res); err != nil {
+			logger(r.Context()).Warn().Err(err).Str("upstream", upstreamHost).Msg("failed to copy upstream response")
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+}
+
+// roundTrip sends a copy of the request to the upstream. The returned cancel func releases the
+// per-try and idle timeouts and must only be called once the response body is no longer needed.
+func (h Handler) roundTrip(r *http.Request, sink *Sink, upstreamHost string, body []byte) (res *http.Response, cancel context.CancelFunc, err error) {
+	r, span := traceRoundTrip(r, sink, upstreamHost)
+	defer func() { endRoundTrip(span, res, err) }()
+	ctx, cancelAttempt := context.WithCancelCause(r.Context())
+	cancel = func() { cancelAttempt(context.Canceled) }
+	if h.Retries != nil && h.Retries.PerTryTimeout > 0 {
+		var cancelTry context.CancelFunc
+		ctx, cancelTry = context.WithTimeout(ctx, h.Retries.PerTryTimeout)
+		cancel = func() { cancelTry(); cancelAttempt(context.Canceled) }
+	}
+	var idle *time.Timer
+	if h.IdleTimeout > 0 {
+		idle = time.AfterFunc(h.IdleTimeout, func() { cancelAttempt(errIdleTimeout) })
+		stopAndCancel := cancel
+		cancel = func() { idle.Stop(); stopAndCancel() }
+	}
+	out := r.Clone(ctx)
+	prepareOutgoing(r, out)
+	h.Rewrite.apply(out)
+	vars := h.headerVars(r, upstreamHost)
+	sink.RequestHeaders.apply(out.Header, vars)
+	h.RequestHeaders.apply(out.Header, vars)
+	// The upstream continues the trace from the span of this attempt
+	tracing.Inject(ctx, out.Header)
+	if len(body) > 0 {
+		// Every attempt replays the buffered body from the start
+		out.Body = io.NopCloser(bytes.NewReader(body))
+	}
 	// Modify the original host with the chosen upstream
-	r.URL.Host = upstreamHost
+	out.URL.Host = upstreamHost
 	// We need to set http or https on the request, only support http for now
-	r.URL.Scheme = "http"
-	res, err := h.Transport.RoundTrip(r)
+	out.URL.Scheme = "http"
+	out.RequestURI = ""
+	res, err = h.Transport.RoundTrip(out)
 	if err != nil {
-		http.Error(w, "error occurred while performing roundtrip", http.StatusBadRequest)
-		return
+		cause := context.Cause(ctx)
+		if errors.Is(cause, context.DeadlineExceeded) || errors.Is(cause, errIdleTimeout) {
+			err = errors.Join(errUpstreamTimeout, err)
+		}
+		return nil, cancel, err
+	}
+	if idle != nil {
+		idle.Reset(h.IdleTimeout)
+		res.Body = &idleTimeoutBody{ReadCloser: res.Body, timer: idle, timeout: h.IdleTimeout}
+	}
+	return res, cancel, nil
+}
+
+func (h Handler) headerVars(r *http.Request, upstreamHost string) headerVars {
+	return headerVars{
+		clientIP:  clientIP(r),
+		route:     h.Name,
+		upstream:  upstreamHost,
+		requestID: r.Header.Get(requestIDHeader),
+	}
+}
+
+// idleTimeoutBody pushes back the idle timeout every time the upstream sends part of the body
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.timeout)
 	}
-	defer res.Body.Close()
-	w.WriteHeader(http.StatusOK)
-	io.Copy(w, res.Body)
+	return n, err
 }
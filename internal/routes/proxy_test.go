@@ -0,0 +1,268 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+// testUpstream starts a backend for the duration of the test and returns it as a config upstream
+func testUpstream(t *testing.T, h http.HandlerFunc) schema.Upstream {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return schema.Upstream{Address: host, Port: p}
+}
+
+// closedUpstream returns an upstream that refuses connections
+func closedUpstream(t *testing.T) schema.Upstream {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve a port: %v", err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	l.Close()
+	return schema.Upstream{Address: "127.0.0.1", Port: addr.Port}
+}
+
+func newTestHandler(upstreams []schema.Upstream, retries *schema.RetryPolicy) Handler {
+	sink := NewSink("app", schema.Sink{
+		Name:      "backend",
+		Strategy:  ptr.To("round-robin"),
+		Upstreams: upstreams,
+	}, NewEndpointRegistry())
+	return Handler{
+		Sink:      sink,
+		Transport: Transport{http.DefaultTransport},
+		Retries:   compileRetryPolicy(retries),
+	}
+}
+
+func TestHandlerRetries(t *testing.T) {
+	var failing atomic.Int32
+	unavailable := testUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		failing.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	echo := testUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte("ok:" + string(body)))
+	})
+
+	t.Run("retries idempotent requests on another upstream", func(t *testing.T) {
+		h := newTestHandler([]schema.Upstream{unavailable, echo}, &schema.RetryPolicy{})
+		for i := 0; i < 4; i++ {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Body.String() != "ok:" {
+				t.Errorf("request %d: expected the request to reach the healthy upstream, got %q", i, rec.Body.String())
+			}
+		}
+	})
+
+	t.Run("every strategy retries on the other upstream", func(t *testing.T) {
+		for _, strategy := range []string{"random", "weighted", "round-robin", "weighted-round-robin", "least-request", "p2c", "hash"} {
+			t.Run(strategy, func(t *testing.T) {
+				h := Handler{
+					Sink: NewSink("app", schema.Sink{
+						Name:      "backend",
+						Strategy:  ptr.To(strategy),
+						Upstreams: []schema.Upstream{unavailable, echo},
+					}, NewEndpointRegistry()),
+					Transport: Transport{http.DefaultTransport},
+					Retries: compileRetryPolicy(&schema.RetryPolicy{
+						Attempts: ptr.To(2),
+						Backoff:  &schema.Backoff{BaseInterval: ptr.To(schema.Duration(time.Millisecond))},
+					}),
+				}
+				for i := 0; i < 100; i++ {
+					rec := httptest.NewRecorder()
+					h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+					if rec.Code != http.StatusOK {
+						t.Fatalf("request %d: expected the retry to reach the healthy upstream, got %d", i, rec.Code)
+					}
+				}
+			})
+		}
+	})
+
+	t.Run("retries connect failures", func(t *testing.T) {
+		h := newTestHandler([]schema.Upstream{closedUpstream(t), echo}, &schema.RetryPolicy{})
+		for i := 0; i < 4; i++ {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Body.String() != "ok:" {
+				t.Errorf("request %d: expected the request to reach the open upstream, got %q", i, rec.Body.String())
+			}
+		}
+	})
+
+	t.Run("does not retry non-idempotent requests by default", func(t *testing.T) {
+		h := newTestHandler([]schema.Upstream{unavailable, echo}, &schema.RetryPolicy{})
+		before := failing.Load()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("payload")))
+		if rec.Body.String() == "ok:payload" {
+			t.Errorf("expected the POST to not be retried")
+		}
+		if failing.Load() != before+1 {
+			t.Errorf("expected exactly one attempt against the failing upstream")
+		}
+	})
+
+	t.Run("replays the buffered body when retrying non-idempotent requests", func(t *testing.T) {
+		h := newTestHandler([]schema.Upstream{unavailable, echo}, &schema.RetryPolicy{RetryNonIdempotent: true})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("payload")))
+		if rec.Body.String() != "ok:payload" {
+			t.Errorf("expected the body to be replayed to the second upstream, got %q", rec.Body.String())
+		}
+	})
+
+	t.Run("bodies over the buffer limit are sent once and intact", func(t *testing.T) {
+		h := newTestHandler([]schema.Upstream{echo, unavailable}, &schema.RetryPolicy{
+			RetryNonIdempotent: true,
+			BufferLimitBytes:   ptr.To[int64](4),
+		})
+		req := httptest.NewRequest(http.MethodPost, "/", io.NopCloser(strings.NewReader("payload")))
+		req.ContentLength = -1
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Body.String() != "ok:payload" {
+			t.Errorf("expected the full body to reach the upstream, got %q", rec.Body.String())
+		}
+	})
+
+	t.Run("gives up after the configured attempts", func(t *testing.T) {
+		h := newTestHandler([]schema.Upstream{unavailable}, &schema.RetryPolicy{Attempts: ptr.To(3)})
+		before := failing.Load()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		if got := failing.Load() - before; got != 3 {
+			t.Errorf("expected 3 attempts, got %d", got)
+		}
+	})
+}
+
+func TestHandlerClientCancellations(t *testing.T) {
+	slow := testUpstream(t, func(w http.ResponseWriter, r *http.Request) { <-r.Context().Done() })
+	h := newTestHandler([]schema.Upstream{slow}, nil)
+	h.Sink = NewSink("app", schema.Sink{
+		Name:             "backend",
+		OutlierDetection: &schema.OutlierDetection{ConsecutiveErrors: ptr.To(2)},
+		Upstreams:        []schema.Upstream{slow},
+	}, NewEndpointRegistry())
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+		cancel()
+	}
+	ep := h.Sink.Endpoints[0]
+	if got := ep.consecutiveFailures.Load(); got != 0 || ep.Ejected() {
+		t.Errorf("expected requests the client gave up on to not count as failures, got %d", got)
+	}
+}
+
+func TestHandlerWithoutUpstreams(t *testing.T) {
+	h := newTestHandler(nil, nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", rec.Code)
+	}
+}
+
+func TestHandlerTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	slow := testUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	stalling := testUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+
+	t.Run("route timeout returns a structured 504", func(t *testing.T) {
+		h := newTestHandler([]schema.Upstream{slow}, nil)
+		h.Timeout = 20 * time.Millisecond
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusGatewayTimeout {
+			t.Fatalf("expected status 504, got %d", rec.Code)
+		}
+		var body errorBody
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("expected a JSON body, got %q: %v", rec.Body.String(), err)
+		}
+		if body.Status != http.StatusGatewayTimeout || body.Error == "" {
+			t.Errorf("unexpected error body %+v", body)
+		}
+	})
+
+	t.Run("idle timeout fires while waiting for the response", func(t *testing.T) {
+		h := newTestHandler([]schema.Upstream{slow}, nil)
+		h.IdleTimeout = 20 * time.Millisecond
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusGatewayTimeout {
+			t.Errorf("expected status 504, got %d", rec.Code)
+		}
+	})
+
+	t.Run("idle timeout cuts off a stalled response body", func(t *testing.T) {
+		h := newTestHandler([]schema.Upstream{stalling}, nil)
+		h.IdleTimeout = 20 * time.Millisecond
+		done := make(chan struct{})
+		rec := httptest.NewRecorder()
+		var aborted any
+		go func() {
+			defer close(done)
+			defer func() { aborted = recover() }()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("expected the stalled response to be cut off")
+		}
+		if rec.Body.String() != "partial" {
+			t.Errorf("expected the partial body to be forwarded, got %q", rec.Body.String())
+		}
+		if aborted != http.ErrAbortHandler {
+			t.Errorf("expected the connection to be aborted, got %v", aborted)
+		}
+	})
+
+	t.Run("per-try timeout moves on to the next upstream", func(t *testing.T) {
+		echo := testUpstream(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+		h := newTestHandler([]schema.Upstream{slow, echo}, &schema.RetryPolicy{
+			PerTryTimeout: ptr.To(schema.Duration(20 * time.Millisecond)),
+		})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Body.String() != "ok" {
+			t.Errorf("expected the retry to reach the fast upstream, got %d %q", rec.Code, rec.Body.String())
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package routes
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestRequestID(t *testing.T) {
+	var logs bytes.Buffer
+	previous := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = previous })
+
+	var seen string
+	backend := testUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get("X-Request-Id")
+		w.Header().Set("X-Request-Id", "made-up-by-the-upstream")
+	})
+	h, err := Compile(schema.App{
+		Name: "app",
+		Routes: []schema.Route{
+			{Path: "/ok", Sink: "backend"},
+			{Path: "/down", Sink: "down"},
+		},
+		Sinks: []schema.Sink{
+			{Name: "backend", Upstreams: []schema.Upstream{backend}},
+			{Name: "down", Upstreams: []schema.Upstream{closedUpstream(t)}},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	tests := []struct {
+		name     string
+		path     string
+		incoming string
+		generate bool
+	}{
+		{name: "incoming id is honored", path: "/ok", incoming: "abc-123"},
+		{name: "missing id is generated", path: "/ok", generate: true},
+		{name: "invalid id is replaced", path: "/ok", incoming: "forged\tline", generate: true},
+		{name: "transport errors carry the id", path: "/down", incoming: "def-456"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			seen = ""
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.incoming != "" {
+				r.Header.Set("X-Request-Id", tt.incoming)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+
+			id := rec.Header().Get("X-Request-Id")
+			if tt.generate && !uuid.MatchString(id) {
+				t.Errorf("expected a generated UUID, got %q", id)
+			}
+			if !tt.generate && id != tt.incoming {
+				t.Errorf("expected the response to carry %q, got %q", tt.incoming, id)
+			}
+			if tt.path == "/ok" && seen != id {
+				t.Errorf("expected the upstream to get %q, got %q", id, seen)
+			}
+			lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+			if tt.path == "/down" && len(lines) < 2 {
+				t.Errorf("expected the transport error to be logged, got %q", lines)
+			}
+			for _, line := range lines {
+				if !strings.Contains(line, `"request_id":"`+id+`"`) {
+					t.Errorf("expected every log line to carry the request id, got %s", line)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	defaultRetryAttempts    = 2
+	defaultBaseBackoff      = 25 * time.Millisecond
+	defaultMaxBackoff       = 250 * time.Millisecond
+	defaultRetryBufferLimit = 64 << 10
+)
+
+var defaultRetryOn = []string{"connect-failure", "502", "503", "504"}
+
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// RetryPolicy is the compiled form of schema.RetryPolicy
+type RetryPolicy struct {
+	Attempts           int
+	PerTryTimeout      time.Duration
+	BaseBackoff        time.Duration
+	MaxBackoff         time.Duration
+	RetryNonIdempotent bool
+	BufferLimit        int64
+
+	connectFailure bool
+	reset          bool
+	any5xx         bool
+	statuses       map[int]bool
+}
+
+func compileRetryPolicy(rp *schema.RetryPolicy) *RetryPolicy {
+	if rp == nil {
+		return nil
+	}
+	p := &RetryPolicy{
+		Attempts:           ptr.Deref(rp.Attempts, defaultRetryAttempts),
+		PerTryTimeout:      time.Duration(ptr.Deref(rp.PerTryTimeout, 0)),
+		BaseBackoff:        defaultBaseBackoff,
+		MaxBackoff:         defaultMaxBackoff,
+		RetryNonIdempotent: rp.RetryNonIdempotent,
+		BufferLimit:        ptr.Deref(rp.BufferLimitBytes, defaultRetryBufferLimit),
+		statuses:           make(map[int]bool),
+	}
+	if rp.Backoff != nil {
+		p.BaseBackoff = time.Duration(ptr.Deref(rp.Backoff.BaseInterval, schema.Duration(defaultBaseBackoff)))
+		p.MaxBackoff = time.Duration(ptr.Deref(rp.Backoff.MaxInterval, schema.Duration(defaultMaxBackoff)))
+	}
+	retryOn := rp.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = defaultRetryOn
+	}
+	for _, cond := range retryOn {
+		switch cond {
+		case "connect-failure":
+			p.connectFailure = true
+		case "reset":
+			p.reset = true
+		case "5xx":
+			p.any5xx = true
+		default:
+			// Admission makes sure that anything else is a status code
+			if code, err := strconv.Atoi(cond); err == nil {
+				p.statuses[code] = true
+			}
+		}
+	}
+	return p
+}
+
+// attempts returns how many times the request may be sent, buffering its body so that it can be
+// replayed. The returned body is nil when the request is not going to be retried.
+func (p *RetryPolicy) attempts(r *http.Request) (int, []byte) {
+	if p == nil || p.Attempts <= 1 {
+		return 1, nil
+	}
+	if !p.RetryNonIdempotent && !idempotentMethods[r.Method] {
+		return 1, nil
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return p.Attempts, []byte{}
+	}
+	buf, ok := bufferBody(r, p.BufferLimit)
+	if !ok {
+		return 1, nil
+	}
+	return p.Attempts, buf
+}
+
+// bufferBody reads the request body into memory so that it can be sent more than once. Bodies over
+// the limit are left to be streamed, in which case it returns false.
+func bufferBody(r *http.Request, limit int64) ([]byte, bool) {
+	if r.ContentLength > limit {
+		return nil, false
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil || int64(len(buf)) > limit {
+		// Whatever was read has to be stitched back in front of the rest of the body
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return nil, false
+	}
+	return buf, true
+}
+
+// shouldRetry decides whether the outcome of an attempt is worth another attempt
+func (p *RetryPolicy) shouldRetry(res *http.Response, err error) bool {
+	if err != nil {
+		// Timed out attempts are always worth retrying, otherwise a per-try timeout would be pointless.
+		// If the route timeout fired instead, the wait before the retry notices and bails out.
+		if errors.Is(err, errUpstreamTimeout) {
+			return true
+		}
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return p.connectFailure
+		}
+		return p.reset
+	}
+	return p.statuses[res.StatusCode] || (p.any5xx && res.StatusCode >= http.StatusInternalServerError)
+}
+
+// wait sleeps before the given retry, returning false if the client went away in the meantime
+func (p *RetryPolicy) wait(ctx context.Context, retry int) bool {
+	ceiling := p.MaxBackoff
+	if shifted := p.BaseBackoff << (retry - 1); shifted > 0 && shifted < ceiling {
+		ceiling = shifted
+	}
+	var d time.Duration
+	if ceiling > 0 {
+		d = time.Duration(rand.Int63n(int64(ceiling) + 1))
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// pickUntried picks an upstream that has not been tried yet for this request. Some strategies keep
+// returning the same upstream (like hash, or least-request once the failed upstream is the least
+// loaded), so after a few picks it takes an untried endpoint of the sink directly. A tried upstream is
+// only picked again once every one was tried.
+func pickUntried(sink *Sink, s LoadbalanceStrategy, r *http.Request, tried map[string]bool) string {
+	addr := s.Pick(r)
+	for i := 1; tried[addr] && i < len(sink.Endpoints); i++ {
+		s.Done(addr)
+		addr = s.Pick(r)
+	}
+	if !tried[addr] {
+		return addr
+	}
+	untried := sink.untried(tried)
+	if untried == "" {
+		return addr
+	}
+	// The request is reported Done for whatever it was sent to, so the strategy has to count it there
+	s.Done(addr)
+	if t, ok := s.(tracker); ok {
+		t.track(untried)
+	}
+	return untried
+}
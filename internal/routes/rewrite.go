@@ -0,0 +1,64 @@
+package routes
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/maxcelant/jap/internal/schema"
+)
+
+// Rewrite changes the outgoing request of a route. A nil Rewrite leaves it as it is.
+type Rewrite struct {
+	Path func(string) string // nil keeps the path
+	Host string              // empty keeps the client's host
+}
+
+// compileRewrite turns the rewrite of the route into path and host changes. The pattern is the compiled
+// path of a regex route, its capture groups can be used by the substitution.
+func compileRewrite(route schema.Route, pattern *regexp.Regexp) *Rewrite {
+	rw := route.Rewrite
+	if rw == nil {
+		return nil
+	}
+	rewrite := &Rewrite{}
+	switch {
+	case rw.StripPrefix != nil:
+		prefix := *rw.StripPrefix
+		rewrite.Path = func(p string) string { return strings.TrimPrefix(p, prefix) }
+	case rw.ReplacePrefix != nil:
+		prefix, replacement := route.Path, *rw.ReplacePrefix
+		rewrite.Path = func(p string) string {
+			if rest, ok := strings.CutPrefix(p, prefix); ok {
+				return replacement + rest
+			}
+			return p
+		}
+	case rw.RegexSubstitution != nil && pattern != nil:
+		substitution := *rw.RegexSubstitution
+		rewrite.Path = func(p string) string { return pattern.ReplaceAllString(p, substitution) }
+	}
+	if rw.Host != nil {
+		rewrite.Host = *rw.Host
+	}
+	return rewrite
+}
+
+// apply rewrites the outgoing request, which has to be a clone of the incoming one
+func (rw *Rewrite) apply(out *http.Request) {
+	if rw == nil {
+		return
+	}
+	if rw.Path != nil {
+		p := rw.Path(out.URL.Path)
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+		out.URL.Path = p
+		// The escaped form belonged to the old path, go escapes the new one itself
+		out.URL.RawPath = ""
+	}
+	if rw.Host != "" {
+		out.Host = rw.Host
+	}
+}
@@ -0,0 +1,65 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+func TestRewrite(t *testing.T) {
+	backend := testUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + r.URL.RequestURI()))
+	})
+	h, err := Compile(schema.App{
+		Name: "app",
+		Routes: []schema.Route{
+			{
+				Path:    "/backend",
+				Match:   ptr.To("prefix"),
+				Rewrite: &schema.Rewrite{StripPrefix: ptr.To("/backend")},
+				Sink:    "backend",
+			},
+			{
+				Path:    "/v1/",
+				Match:   ptr.To("prefix"),
+				Rewrite: &schema.Rewrite{ReplacePrefix: ptr.To("/api/v2/"), Host: ptr.To("api.internal")},
+				Sink:    "backend",
+			},
+			{
+				Path:    `^/users/([0-9]+)/orders/(?P<order>[0-9]+)$`,
+				Match:   ptr.To("regex"),
+				Rewrite: &schema.Rewrite{RegexSubstitution: ptr.To("/orders/${order}/user/$1")},
+				Sink:    "backend",
+			},
+		},
+		Sinks: []schema.Sink{{Name: "backend", Upstreams: []schema.Upstream{backend}}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		expected string
+	}{
+		{name: "strip prefix", path: "/backend/pay?id=7", expected: "shop.example.com/pay?id=7"},
+		{name: "stripping the whole path leaves the root", path: "/backend", expected: "shop.example.com/"},
+		{name: "replace prefix and host", path: "/v1/users", expected: "api.internal/api/v2/users"},
+		{name: "regex substitution with capture groups", path: "/users/12/orders/34", expected: "shop.example.com/orders/34/user/12"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			r.Host = "shop.example.com"
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Body.String() != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, rec.Body.String())
+			}
+		})
+	}
+}
@@ -1,69 +1,187 @@
 package routes
 
 import (
+	"cmp"
 	"fmt"
 	"net/http"
 	"regexp"
-	"slices"
+	"time"
 
+	"github.com/maxcelant/jap/internal/accesslog"
 	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
 )
 
-// Compile will create a handler chain based off of the given config schema
-func Compile(app schema.App) (http.Handler, error) {
-	handlers := make([]Handler, len(app.Routes))
+// Compile will create a route table based off of the given config schema. The endpoints of every sink
+// are taken from the registry so that their state is shared with previously compiled route tables.
+func Compile(app schema.App, registry *EndpointRegistry) (http.Handler, error) {
+	if registry == nil {
+		registry = NewEndpointRegistry()
+	}
+	// Sinks are compiled once so that every route sending to the same sink shares its strategy
+	sinks := make(map[string]*Sink, len(app.Sinks))
+	for _, s := range app.Sinks {
+		sinks[s.Name] = NewSink(app.Name, s, registry)
+	}
+	table := &RouteTable{}
 	for _, r := range app.Routes {
-		i := slices.IndexFunc(app.Sinks, func(sink schema.Sink) bool {
-			return sink.Name == r.Sink
-		})
-		if i == -1 {
-			return nil, fmt.Errorf("failed to find sink with name '%s'", r.Sink)
-		}
-		lbStrategy := compileRoutingStrategy(app.Sinks[i])
 		matchers, err := compileMatchers(r)
 		if err != nil {
 			return nil, fmt.Errorf("failed to compile matchers: %w", err)
 		}
-		rh := Handler{
-			Transport: Transport{
-				RoundTripper: http.DefaultTransport,
-			},
-			Upstreams: Upstreams{
-				Strategy: lbStrategy,
-			},
-			Matchers: matchers,
+		var pattern *regexp.Regexp
+		if ptr.Deref(r.Match, "exact") == "regex" {
+			if pattern, err = regexp.Compile(r.Path); err != nil {
+				return nil, fmt.Errorf("failed to turn route path into regex: %w", err)
+			}
+		}
+		route := &Route{Name: cmp.Or(r.Name, r.Path), Matchers: matchers, LogPercent: 100}
+		if al := r.AccessLog; al != nil {
+			route.LogPercent = ptr.Deref(al.Percent, 100)
+			if al.Disabled {
+				route.LogPercent = 0
+			}
+		}
+		switch {
+		case r.Redirect != nil:
+			route.Handler = compileRedirect(*r.Redirect, pattern)
+		case r.DirectResponse != nil:
+			if route.Handler, err = compileDirectResponse(*r.DirectResponse); err != nil {
+				return nil, fmt.Errorf("failed to compile direct response of route %q: %w", r.Path, err)
+			}
+		default:
+			var split *SinkSplit
+			if len(r.Sinks) > 0 {
+				if split, err = compileSinkSplit(r, sinks); err != nil {
+					return nil, err
+				}
+			}
+			sink, ok := sinks[r.Sink]
+			if !ok && split == nil {
+				return nil, fmt.Errorf("failed to find sink with name '%s'", r.Sink)
+			}
+			route.Handler = &Handler{
+				Transport: Transport{
+					RoundTripper: http.DefaultTransport,
+				},
+				Name:            route.Name,
+				Sink:            sink,
+				Split:           split,
+				RequestHeaders:  compileHeaderOps(r.RequestHeaders),
+				ResponseHeaders: compileHeaderOps(r.ResponseHeaders),
+				Retries:         compileRetryPolicy(r.Retries),
+				Rewrite:         compileRewrite(r, pattern),
+				Mirror:          compileMirror(r.Mirror, sinks),
+				Timeout:         time.Duration(ptr.Deref(r.Timeout, 0)),
+				IdleTimeout:     time.Duration(ptr.Deref(r.IdleTimeout, 0)),
+			}
+		}
+		faults, err := compileFaults(r.Faults)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile faults of route %q: %w", r.Path, err)
+		}
+		if faults != nil {
+			route.Handler = faultInjection(faults)(route.Handler)
+		}
+		switch ptr.Deref(r.Match, "exact") {
+		case "exact":
+			table.AddExact(r.Path, route)
+		case "prefix":
+			table.AddPrefix(r.Path, route)
+		case "regex":
+			table.AddRegex(pattern, route)
 		}
-		handlers[i] = rh
 	}
-	// Chain the handlers together
-	next := emptyHandler
-	for _, r := range handlers {
-		next = wrapRoutes(r)(next)
+	var logger *accesslog.Logger
+	if app.AccessLog != nil {
+		var err error
+		if logger, err = accesslog.New(*app.AccessLog); err != nil {
+			return nil, fmt.Errorf("failed to create access log: %w", err)
+		}
 	}
-	// Wrap with logging middleware as the outermost layer
-	return loggerRoute(next), nil
+	// Wrap with the access log, and the request ID outside of it so that the log lines carry the ID.
+	// The server span is inside both, so that it covers the same time as the logged duration.
+	return requestID(observe(app.Name, logger)(traced(table))), nil
+}
+
+// compileSinkSplit splits the traffic of the route over its sinks. Sticky routes hash on the key of
+// their sticky policy, any other route picks a sink at random.
+func compileSinkSplit(route schema.Route, sinks map[string]*Sink) (*SinkSplit, error) {
+	split := make([]*Sink, len(route.Sinks))
+	weights := make([]int, len(route.Sinks))
+	for i, ws := range route.Sinks {
+		sink, ok := sinks[ws.Name]
+		if !ok {
+			return nil, fmt.Errorf("failed to find sink with name '%s'", ws.Name)
+		}
+		split[i], weights[i] = sink, ws.Weight
+	}
+	var key HashKeyFunc
+	if route.Sticky != nil {
+		key = compileHashKey(route.Sticky)
+	}
+	return NewSinkSplit(split, weights, key), nil
 }
 
 func compileMatchers(route schema.Route) (MatcherList, error) {
 	var ml []Matcher
-	switch route.Path {
-	case "exact":
-		ml = append(ml, PathMatcher{route.Path})
-	case "prefix":
-		ml = append(ml, PrefixMatcher{route.Path})
-	case "regex":
-		re, err := regexp.Compile(route.Path)
+	if route.Methods != nil && len(*route.Methods) != 0 {
+		ml = append(ml, MethodMatcher{*route.Methods})
+	}
+	for _, hm := range route.Headers {
+		m, err := compileHeaderMatcher(hm)
 		if err != nil {
-			return ml, fmt.Errorf("failed to turn route path into regex: %w", err)
+			return ml, err
 		}
-		ml = append(ml, RegexMatcher{re})
+		ml = append(ml, m)
 	}
-	if route.Methods != nil && len(*route.Methods) != 0 {
-		ml = append(ml, MethodMatcher{*route.Methods})
+	for _, qm := range route.QueryParams {
+		vm, err := compileValueMatch(qm)
+		if err != nil {
+			return ml, fmt.Errorf("failed to compile regex for query parameter %q: %w", qm.Name, err)
+		}
+		ml = append(ml, QueryMatcher{qm.Name, vm})
+	}
+	for _, cm := range route.Cookies {
+		vm, err := compileValueMatch(cm)
+		if err != nil {
+			return ml, fmt.Errorf("failed to compile regex for cookie %q: %w", cm.Name, err)
+		}
+		ml = append(ml, CookieMatcher{cm.Name, vm})
 	}
 	return ml, nil
 }
 
+func compileHeaderMatcher(hm schema.HeaderMatch) (HeaderMatcher, error) {
+	m := HeaderMatcher{
+		Name:    hm.Name,
+		Exact:   hm.Exact,
+		Prefix:  hm.Prefix,
+		Present: hm.Present,
+		Invert:  hm.Invert,
+	}
+	if hm.Regex != nil {
+		re, err := regexp.Compile(*hm.Regex)
+		if err != nil {
+			return m, fmt.Errorf("failed to compile regex for header %q: %w", hm.Name, err)
+		}
+		m.Regex = re
+	}
+	return m, nil
+}
+
+func compileValueMatch(m schema.ValueMatch) (valueMatch, error) {
+	vm := valueMatch{Exact: m.Exact, Present: m.Present}
+	if m.Regex != nil {
+		re, err := regexp.Compile(*m.Regex)
+		if err != nil {
+			return vm, err
+		}
+		vm.Regex = re
+	}
+	return vm, nil
+}
+
 // compileRoutingStrategy picks an appropriate loadbalancing strategy based on the fields in the Sinkfile
 func compileRoutingStrategy(sink schema.Sink) LoadbalanceStrategy {
 	upstreams := sink.Upstreams
@@ -75,29 +193,54 @@ func compileRoutingStrategy(sink schema.Sink) LoadbalanceStrategy {
 			return buildWeightedStrategy(upstreams)
 		case "random":
 			return buildRandomStrategy(upstreams)
+		case "round-robin":
+			return NewRoundRobinStrategy(upstreamAddrs(upstreams))
+		case "weighted-round-robin":
+			return NewSmoothWeightedStrategy(upstreamWeights(upstreams))
+		case "least-request":
+			return NewLeastRequestStrategy(upstreamAddrs(upstreams))
+		case "p2c":
+			return NewP2CStrategy(upstreamAddrs(upstreams))
+		case "hash":
+			return NewRingHashStrategy(upstreamWeights(upstreams), compileHashKey(sink.Hash))
 		}
 	}
 
-	// Auto-detect: if any upstream has a weight, use weighted strategy
-	for _, u := range upstreams {
-		if u.Weight != nil {
-			return buildWeightedStrategy(upstreams)
-		}
+	// Auto-detect with the same rule as the defaulter: weighted only when every upstream has a weight
+	if allWeighted(upstreams) {
+		return buildWeightedStrategy(upstreams)
 	}
 
 	// Default to random strategy
 	return buildRandomStrategy(upstreams)
 }
 
+func allWeighted(upstreams []schema.Upstream) bool {
+	for _, u := range upstreams {
+		if u.Weight == nil || *u.Weight == 0 {
+			return false
+		}
+	}
+	return len(upstreams) > 0
+}
+
 func buildRandomStrategy(upstreams []schema.Upstream) RandomStrategy {
+	return RandomStrategy{upstreamAddrs(upstreams)}
+}
+
+func buildWeightedStrategy(upstreams []schema.Upstream) RandomWeightStrategy {
+	return RandomWeightStrategy{upstreamWeights(upstreams)}
+}
+
+func upstreamAddrs(upstreams []schema.Upstream) []string {
 	addrs := make([]string, len(upstreams))
 	for i, u := range upstreams {
 		addrs[i] = fmt.Sprintf("%s:%d", u.Address, u.Port)
 	}
-	return RandomStrategy{addrs}
+	return addrs
 }
 
-func buildWeightedStrategy(upstreams []schema.Upstream) RandomWeightStrategy {
+func upstreamWeights(upstreams []schema.Upstream) []AddrWeight {
 	addrWeights := make([]AddrWeight, len(upstreams))
 	for i, u := range upstreams {
 		weight := 1 // default weight
@@ -109,22 +252,5 @@ func buildWeightedStrategy(upstreams []schema.Upstream) RandomWeightStrategy {
 			Weight: weight,
 		}
 	}
-	return RandomWeightStrategy{addrWeights}
-}
-
-// wrapRoutes creates a handler chain to easily perform route matching
-func wrapRoutes(rh Handler) Middleware {
-	// We need to do it this way because we need to inject some the route matching context in the handler chain
-	return func(next http.Handler) http.Handler {
-		// This is where we need to actually do the routing matches
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// If the request matches this handler, stop the chain and handle the request accordingly.
-			if rh.Matchers.Match(*r) {
-				rh.ServeHTTP(w, r)
-				return
-			}
-			// Otherwise, just continue down the chain
-			next.ServeHTTP(w, r)
-		})
-	}
+	return addrWeights
 }
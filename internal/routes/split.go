@@ -0,0 +1,47 @@
+package routes
+
+import (
+	"math/rand"
+	"net/http"
+	"slices"
+)
+
+// SinkSplit spreads the requests of a route over several sinks by weight. With a key the split is
+// sticky: a client keeps going to the same sink, and when the weights shift only the clients in the
+// shifted share move.
+type SinkSplit struct {
+	Key        HashKeyFunc // nil when the split is not sticky
+	sinks      []*Sink
+	cumulative []int // cumulative[i] is the sum of the weights up to and including sinks[i]
+}
+
+func NewSinkSplit(sinks []*Sink, weights []int, key HashKeyFunc) *SinkSplit {
+	s := &SinkSplit{Key: key, sinks: sinks, cumulative: make([]int, len(weights))}
+	total := 0
+	for i, w := range weights {
+		total += w
+		s.cumulative[i] = total
+	}
+	return s
+}
+
+// pick chooses the sink for the request
+func (s *SinkSplit) pick(r *http.Request) *Sink {
+	total := s.cumulative[len(s.cumulative)-1]
+	var n int
+	if key, ok := s.key(r); ok {
+		n = int(hashString(key) % uint64(total))
+	} else {
+		n = rand.Intn(total)
+	}
+	// The first sink whose cumulative weight is past n owns it, sinks without weight never do
+	i, _ := slices.BinarySearch(s.cumulative, n+1)
+	return s.sinks[i]
+}
+
+func (s *SinkSplit) key(r *http.Request) (string, bool) {
+	if s.Key == nil {
+		return "", false
+	}
+	return s.Key(r)
+}
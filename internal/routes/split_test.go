@@ -0,0 +1,97 @@
+package routes
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+func TestSinkSplit(t *testing.T) {
+	v1, v2, v3 := &Sink{Name: "v1"}, &Sink{Name: "v2"}, &Sink{Name: "v3"}
+	userKey := compileHashKey(&schema.HashPolicy{Header: ptr.To("x-user")})
+	request := func(user string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if user != "" {
+			r.Header.Set("x-user", user)
+		}
+		return r
+	}
+
+	t.Run("requests are spread by weight", func(t *testing.T) {
+		split := NewSinkSplit([]*Sink{v1, v2, v3}, []int{95, 5, 0}, nil)
+		counts := map[*Sink]int{}
+		const n = 20000
+		for range n {
+			counts[split.pick(request(""))]++
+		}
+		if share := float64(counts[v2]) / n; math.Abs(share-0.05) > 0.01 {
+			t.Errorf("expected v2 to get about 5%% of the requests, got %.2f%%", share*100)
+		}
+		if counts[v3] != 0 {
+			t.Errorf("expected the sink without weight to get nothing, got %d requests", counts[v3])
+		}
+	})
+
+	t.Run("sticky clients keep their sink", func(t *testing.T) {
+		split := NewSinkSplit([]*Sink{v1, v2}, []int{50, 50}, userKey)
+		for i := range 100 {
+			user := fmt.Sprintf("user-%d", i)
+			first := split.pick(request(user))
+			for range 5 {
+				if got := split.pick(request(user)); got != first {
+					t.Fatalf("expected %s to stay on %s, got %s", user, first.Name, got.Name)
+				}
+			}
+		}
+	})
+
+	t.Run("shifting weights only moves clients into the grown share", func(t *testing.T) {
+		before := NewSinkSplit([]*Sink{v1, v2}, []int{95, 5}, userKey)
+		after := NewSinkSplit([]*Sink{v1, v2}, []int{90, 10}, userKey)
+		moved := 0
+		for i := range 1000 {
+			r := request(fmt.Sprintf("user-%d", i))
+			was, is := before.pick(r), after.pick(r)
+			if was == v2 && is != v2 {
+				t.Fatalf("expected the canary clients to stay on the canary")
+			}
+			if was != is {
+				moved++
+			}
+		}
+		if moved == 0 || moved > 100 {
+			t.Errorf("expected about 5%% of the clients to move to the canary, got %d of 1000", moved)
+		}
+	})
+}
+
+func TestCompileSinkSplit(t *testing.T) {
+	v1 := testUpstream(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("v1")) })
+	v2 := testUpstream(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("v2")) })
+	h, err := Compile(schema.App{
+		Name: "app",
+		Routes: []schema.Route{{
+			Path:   "/",
+			Match:  ptr.To("prefix"),
+			Sinks:  []schema.WeightedSink{{Name: "v1", Weight: 0}, {Name: "v2", Weight: 1}},
+			Sticky: &schema.HashPolicy{Cookie: ptr.To("session")},
+		}},
+		Sinks: []schema.Sink{
+			{Name: "v1", Upstreams: []schema.Upstream{v1}},
+			{Name: "v2", Upstreams: []schema.Upstream{v2}},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Body.String() != "v2" {
+		t.Errorf("expected %q, got %q", "v2", rec.Body.String())
+	}
+}
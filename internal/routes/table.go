@@ -0,0 +1,161 @@
+package routes
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/maxcelant/jap/internal/tracing"
+)
+
+// RouteTable finds the route for a request without walking every route. Exact and prefix paths live in a
+// radix tree and regex paths are tried in order afterwards. The precedence is:
+//
+//  1. an exact path match
+//  2. the longest prefix match
+//  3. the first regex match
+//
+// Routes with the same path and match type are tried in the order they were added, so the first one
+// whose other matchers (methods, headers, ...) accept the request wins.
+type RouteTable struct {
+	root  radixNode
+	regex []regexRoute
+}
+
+// Route is an entry of the route table. Its handler serves the requests that match both the path it was
+// added with and its matchers.
+type Route struct {
+	Name     string
+	Matchers MatcherList
+	http.Handler
+	// LogPercent is the share of the requests of the route that get an access log line
+	LogPercent float64
+}
+
+type regexRoute struct {
+	pattern *regexp.Regexp
+	route   *Route
+}
+
+// radixNode is a node of a compressed radix tree over the bytes of a path. The path of a node is the
+// concatenation of the labels from the root down to it.
+type radixNode struct {
+	label    string
+	children map[byte]*radixNode
+	exact    []*Route
+	prefix   []*Route
+}
+
+// AddExact adds a route that only matches the given path
+func (t *RouteTable) AddExact(path string, route *Route) {
+	n := t.root.insert(path)
+	n.exact = append(n.exact, route)
+}
+
+// AddPrefix adds a route that matches every path starting with the given prefix
+func (t *RouteTable) AddPrefix(prefix string, route *Route) {
+	n := t.root.insert(prefix)
+	n.prefix = append(n.prefix, route)
+}
+
+// AddRegex adds a route that matches every path the pattern matches
+func (t *RouteTable) AddRegex(pattern *regexp.Regexp, route *Route) {
+	t.regex = append(t.regex, regexRoute{pattern, route})
+}
+
+// Lookup returns the route matching the request, or nil if there is none
+func (t *RouteTable) Lookup(r *http.Request) *Route {
+	if route := t.root.lookup(r.URL.Path, r); route != nil {
+		return route
+	}
+	for _, rr := range t.regex {
+		if rr.pattern.MatchString(r.URL.Path) && rr.route.Matchers.Match(r) {
+			return rr.route
+		}
+	}
+	return nil
+}
+
+func (t *RouteTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, span := tracing.Start(r.Context(), "route match", tracing.KindInternal)
+	route := t.Lookup(r)
+	if route == nil {
+		span.End()
+		emptyHandler.ServeHTTP(w, r)
+		return
+	}
+	span.SetString("jap.route", route.Name)
+	span.End()
+	if server := tracing.SpanFromContext(r.Context()); server != nil {
+		server.SetName(r.Method + " " + route.Name)
+		server.SetString("http.route", route.Name)
+	}
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.route = route.Name
+		info.logPercent = route.LogPercent
+		inFlight := requestsInFlight.With(info.app, route.Name)
+		inFlight.Inc()
+		defer inFlight.Dec()
+	}
+	route.ServeHTTP(w, r)
+}
+
+// insert returns the node for the path below n, splitting labels where the path diverges from them
+func (n *radixNode) insert(path string) *radixNode {
+	for path != "" {
+		child, ok := n.children[path[0]]
+		if !ok {
+			child = &radixNode{label: path}
+			if n.children == nil {
+				n.children = make(map[byte]*radixNode)
+			}
+			n.children[path[0]] = child
+			return child
+		}
+		common := commonPrefixLen(path, child.label)
+		if common < len(child.label) {
+			// Split the child so that the shared part of the label becomes its own node
+			split := &radixNode{
+				label:    child.label[:common],
+				children: map[byte]*radixNode{child.label[common]: child},
+			}
+			child.label = child.label[common:]
+			n.children[path[0]] = split
+			child = split
+		}
+		n = child
+		path = path[common:]
+	}
+	return n
+}
+
+// lookup matches the rest of the path below n. Going deeper first means an exact match beats any prefix
+// match, and longer prefixes are tried before shorter ones on the way back up.
+func (n *radixNode) lookup(path string, r *http.Request) *Route {
+	if path == "" {
+		if route := firstMatch(n.exact, r); route != nil {
+			return route
+		}
+	} else if child, ok := n.children[path[0]]; ok && len(path) >= len(child.label) && path[:len(child.label)] == child.label {
+		if route := child.lookup(path[len(child.label):], r); route != nil {
+			return route
+		}
+	}
+	return firstMatch(n.prefix, r)
+}
+
+func firstMatch(routes []*Route, r *http.Request) *Route {
+	for _, route := range routes {
+		if route.Matchers.Match(r) {
+			return route
+		}
+	}
+	return nil
+}
+
+func commonPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,106 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"k8s.io/utils/ptr"
+)
+
+func TestRouteTable(t *testing.T) {
+	routes := map[string]*Route{}
+	route := func(name string, matchers ...Matcher) *Route {
+		route := &Route{Matchers: matchers}
+		routes[name] = route
+		return route
+	}
+	var table RouteTable
+	// Regex and shorter prefixes are added first to show that precedence does not depend on order
+	table.AddRegex(regexp.MustCompile(`^/api/v[0-9]+/users$`), route("regex"))
+	table.AddPrefix("/", route("root"))
+	table.AddPrefix("/api", route("api"))
+	table.AddPrefix("/api/v1", route("v1"))
+	table.AddPrefix("/api/v1", route("v1-any-method"))
+	table.AddExact("/api/v1/users", route("users-post", MethodMatcher{[]string{"POST"}}))
+	table.AddExact("/api/v1/users", route("users"))
+	table.AddPrefix("/apiary", route("apiary"))
+	table.AddExact("/api/v2/users/me", route("me", HeaderMatcher{Name: "authorization", Present: ptr.To(true)}))
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		header   string
+		expected string
+	}{
+		{name: "exact beats prefix and regex", method: "GET", path: "/api/v1/users", expected: "users"},
+		{name: "routes with the same path are tried in order", method: "POST", path: "/api/v1/users", expected: "users-post"},
+		{name: "longest prefix wins", method: "GET", path: "/api/v1/orders", expected: "v1"},
+		{name: "shorter prefix when the longer one diverges", method: "GET", path: "/api/v3/orders", expected: "api"},
+		{name: "prefixes are not bound to segments", method: "GET", path: "/apiary/bees", expected: "apiary"},
+		{name: "prefix beats regex", method: "GET", path: "/api/v2/users", expected: "api"},
+		{name: "exact route whose matchers fail falls back to a prefix", method: "GET", path: "/api/v2/users/me", expected: "api"},
+		{name: "exact route whose matchers pass", method: "GET", path: "/api/v2/users/me", header: "Bearer x", expected: "me"},
+		{name: "catch-all prefix", method: "GET", path: "/other", expected: "root"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			if got := table.Lookup(r); got != routes[tt.expected] {
+				t.Errorf("expected route %q, got %v", tt.expected, nameOf(routes, got))
+			}
+		})
+	}
+
+	t.Run("regex is used when nothing else matches", func(t *testing.T) {
+		var table RouteTable
+		table.AddExact("/health", route("health"))
+		table.AddRegex(regexp.MustCompile(`^/api/v[0-9]+/users$`), routes["regex"])
+		if got := table.Lookup(httptest.NewRequest("GET", "/api/v9/users", nil)); got != routes["regex"] {
+			t.Errorf("expected route %q, got %v", "regex", nameOf(routes, got))
+		}
+		if got := table.Lookup(httptest.NewRequest("GET", "/healthz", nil)); got != nil {
+			t.Errorf("expected no route, got %v", nameOf(routes, got))
+		}
+	})
+}
+
+func nameOf(routes map[string]*Route, route *Route) string {
+	for name, r := range routes {
+		if r == route {
+			return name
+		}
+	}
+	return "<nil>"
+}
+
+// BenchmarkRouteTable looks up a route in tables of growing size. Exact and prefix lookups only depend on
+// the length of the path, so their cost should stay flat as the number of routes grows.
+func BenchmarkRouteTable(b *testing.B) {
+	for _, size := range []int{10, 100, 1000} {
+		var table RouteTable
+		for i := range size {
+			table.AddExact(fmt.Sprintf("/service-%d/items", i), &Route{})
+			table.AddPrefix(fmt.Sprintf("/service-%d/", i), &Route{})
+		}
+		requests := map[string]*http.Request{
+			"exact":  httptest.NewRequest(http.MethodGet, fmt.Sprintf("/service-%d/items", size-1), nil),
+			"prefix": httptest.NewRequest(http.MethodGet, fmt.Sprintf("/service-%d/items/42", size-1), nil),
+			"miss":   httptest.NewRequest(http.MethodGet, "/unknown/items", nil),
+		}
+		for kind, r := range requests {
+			b.Run(fmt.Sprintf("%s/%d", kind, size), func(b *testing.B) {
+				b.ReportAllocs()
+				for b.Loop() {
+					table.Lookup(r)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/maxcelant/jap/internal/tracing"
+)
+
+// traced starts the server span of a request, continuing the trace of the client when it sent a
+// traceparent header and starting a new one otherwise. The span is named after the route once it is
+// matched. While tracing is off the request passes through untouched.
+var traced Middleware = func(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header), r.Method, tracing.KindServer)
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer span.End()
+		span.SetString("http.request.method", r.Method)
+		span.SetString("url.path", r.URL.Path)
+		span.SetString("server.address", r.Host)
+		span.SetString("client.address", clientIP(r))
+		if id := r.Header.Get(requestIDHeader); id != "" {
+			span.SetString("jap.request_id", id)
+		}
+		rr := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(rr, r.WithContext(ctx))
+		span.SetInt("http.response.status_code", rr.statusCode)
+		if rr.statusCode >= http.StatusInternalServerError {
+			span.Fail(http.StatusText(rr.statusCode))
+		}
+	})
+}
+
+// traceRoundTrip starts the client span of an attempt to reach an upstream
+func traceRoundTrip(r *http.Request, sink *Sink, upstreamHost string) (*http.Request, *tracing.Span) {
+	ctx, span := tracing.Start(r.Context(), r.Method, tracing.KindClient)
+	if span == nil {
+		return r, nil
+	}
+	span.SetString("http.request.method", r.Method)
+	span.SetString("server.address", upstreamHost)
+	span.SetString("jap.sink", sink.Name)
+	return r.WithContext(ctx), span
+}
+
+// endRoundTrip records the outcome of an attempt on its span
+func endRoundTrip(span *tracing.Span, res *http.Response, err error) {
+	switch {
+	case err != nil:
+		span.Fail(err.Error())
+	case res.StatusCode >= http.StatusInternalServerError:
+		span.SetInt("http.response.status_code", res.StatusCode)
+		span.Fail(http.StatusText(res.StatusCode))
+	default:
+		span.SetInt("http.response.status_code", res.StatusCode)
+	}
+	span.End()
+}
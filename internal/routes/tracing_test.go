@@ -0,0 +1,89 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"github.com/maxcelant/jap/internal/tracing"
+)
+
+func TestTracing(t *testing.T) {
+	// The collector only keeps the span names and trace IDs, the encoding is tested in the tracing package
+	type span struct {
+		TraceID      string `json:"traceId"`
+		SpanID       string `json:"spanId"`
+		ParentSpanID string `json:"parentSpanId"`
+		Name         string `json:"name"`
+	}
+	var mu sync.Mutex
+	var spans []span
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []span `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	defer collector.Close()
+	interval := schema.Duration(time.Hour)
+	if err := tracing.Configure(&schema.Tracing{Endpoint: collector.URL, FlushInterval: &interval}); err != nil {
+		t.Fatalf("failed to configure tracing: %v", err)
+	}
+	defer tracing.Shutdown(context.Background())
+
+	var upstreamTraceparent string
+	backend := testUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("Traceparent")
+	})
+	h, err := Compile(schema.App{
+		Name:   "app",
+		Routes: []schema.Route{{Name: "orders", Path: "/orders", Sink: "backend"}},
+		Sinks:  []schema.Sink{{Name: "backend", Upstreams: []schema.Upstream{backend}}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/orders", nil)
+	r.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if err := tracing.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to flush spans: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	byName := make(map[string]span)
+	for _, s := range spans {
+		if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("expected span %q to continue the trace of the client, got trace %s", s.Name, s.TraceID)
+		}
+		byName[s.Name] = s
+	}
+	server, match, client := byName["GET orders"], byName["route match"], byName["GET"]
+	if server.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("expected the server span to be a child of the client span, got parent %q", server.ParentSpanID)
+	}
+	if match.ParentSpanID != server.SpanID || client.ParentSpanID != server.SpanID {
+		t.Errorf("expected the route match and upstream spans to be children of the server span, got %+v", spans)
+	}
+	if !strings.Contains(upstreamTraceparent, "-"+client.SpanID+"-") {
+		t.Errorf("expected the upstream to continue from the upstream span %s, got %q", client.SpanID, upstreamTraceparent)
+	}
+}
@@ -0,0 +1,127 @@
+package routes
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/maxcelant/jap/internal/schema"
+)
+
+// VirtualHosts multiplexes the apps that share a listener by the host the request was sent to. For
+// HTTP/2 requests that is the :authority pseudo header, which go exposes as the request Host.
+type VirtualHosts struct {
+	ports map[int]*hostTable
+}
+
+// hostTable holds the apps of a single listener. Exact hosts win over wildcards, longer wildcards win
+// over shorter ones and the app without any hosts gets whatever is left.
+type hostTable struct {
+	exact     map[string]http.Handler
+	wildcards []wildcardHost
+	fallback  http.Handler
+}
+
+type wildcardHost struct {
+	suffix  string // ".example.com" for "*.example.com"
+	handler http.Handler
+}
+
+// CompileApps compiles every app and puts it on each of its listeners under each of its hosts
+func CompileApps(apps []schema.App, registry *EndpointRegistry) (*VirtualHosts, error) {
+	vh := &VirtualHosts{ports: make(map[int]*hostTable)}
+	for _, app := range apps {
+		h, err := Compile(app, registry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile app %q: %w", app.Name, err)
+		}
+		for _, port := range app.Listeners {
+			table, ok := vh.ports[port]
+			if !ok {
+				table = &hostTable{exact: make(map[string]http.Handler)}
+				vh.ports[port] = table
+			}
+			if err := table.add(app.Hosts, h); err != nil {
+				return nil, fmt.Errorf("app %q on listener %d: %w", app.Name, port, err)
+			}
+		}
+	}
+	for _, table := range vh.ports {
+		slices.SortStableFunc(table.wildcards, func(a, b wildcardHost) int { return len(b.suffix) - len(a.suffix) })
+	}
+	return vh, nil
+}
+
+func (t *hostTable) add(hosts []string, h http.Handler) error {
+	if len(hosts) == 0 {
+		if t.fallback != nil {
+			return fmt.Errorf("another app without hosts already claims the listener")
+		}
+		t.fallback = h
+		return nil
+	}
+	for _, host := range hosts {
+		host = normalizeHost(host)
+		if suffix, ok := strings.CutPrefix(host, "*"); ok {
+			if slices.ContainsFunc(t.wildcards, func(w wildcardHost) bool { return w.suffix == suffix }) {
+				return fmt.Errorf("host %q is already claimed by another app", host)
+			}
+			t.wildcards = append(t.wildcards, wildcardHost{suffix, h})
+			continue
+		}
+		if _, ok := t.exact[host]; ok {
+			return fmt.Errorf("host %q is already claimed by another app", host)
+		}
+		t.exact[host] = h
+	}
+	return nil
+}
+
+func (t *hostTable) lookup(host string) http.Handler {
+	if h, ok := t.exact[host]; ok {
+		return h
+	}
+	for _, w := range t.wildcards {
+		// The wildcard needs at least one label in front of it, so *.example.com does not match example.com
+		if len(host) > len(w.suffix) && strings.HasSuffix(host, w.suffix) {
+			return w.handler
+		}
+	}
+	return t.fallback
+}
+
+func (vh *VirtualHosts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	table, ok := vh.ports[localPort(r)]
+	if !ok {
+		writeError(w, http.StatusNotFound, "no app is listening on this port")
+		return
+	}
+	h := table.lookup(normalizeHost(r.Host))
+	if h == nil {
+		writeError(w, http.StatusNotFound, "no app is configured for this host")
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// localPort is the port of the listener the request came in on
+func localPort(r *http.Request) int {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return 0
+	}
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.Port
+	}
+	return 0
+}
+
+// normalizeHost lowercases the host and drops the port and any trailing dot
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,116 @@
+package routes
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+func testApp(t *testing.T, name string, hosts []string, listeners ...int) schema.App {
+	backend := testUpstream(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(name)) })
+	return schema.App{
+		Name:      name,
+		Hosts:     hosts,
+		Listeners: listeners,
+		Routes:    []schema.Route{{Path: "/", Match: ptr.To("prefix"), Sink: "backend"}},
+		Sinks:     []schema.Sink{{Name: "backend", Upstreams: []schema.Upstream{backend}}},
+	}
+}
+
+func TestVirtualHosts(t *testing.T) {
+	vh, err := CompileApps([]schema.App{
+		testApp(t, "shop", []string{"shop.example.com"}, 8080),
+		testApp(t, "tenants", []string{"*.example.com"}, 8080),
+		testApp(t, "eu", []string{"*.eu.example.com"}, 8080),
+		testApp(t, "default", nil, 8080),
+		testApp(t, "admin", []string{"admin.example.com"}, 9090),
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		port     int
+		host     string
+		status   int
+		expected string
+	}{
+		{name: "exact host", port: 8080, host: "shop.example.com", status: 200, expected: "shop"},
+		{name: "host is case insensitive and ignores the port", port: 8080, host: "SHOP.example.com:8080", status: 200, expected: "shop"},
+		{name: "wildcard host", port: 8080, host: "acme.example.com", status: 200, expected: "tenants"},
+		{name: "wildcard matches deeper subdomains", port: 8080, host: "a.b.example.com", status: 200, expected: "tenants"},
+		{name: "longest wildcard wins", port: 8080, host: "acme.eu.example.com", status: 200, expected: "eu"},
+		{name: "wildcard does not match the apex", port: 8080, host: "example.com", status: 200, expected: "default"},
+		{name: "app without hosts gets the rest", port: 8080, host: "other.org", status: 200, expected: "default"},
+		{name: "apps on another listener are separate", port: 9090, host: "admin.example.com", status: 200, expected: "admin"},
+		{name: "unknown host without a fallback", port: 9090, host: "shop.example.com", status: 404},
+		{name: "listener without apps", port: 7070, host: "shop.example.com", status: 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Host = tt.host
+			r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.TCPAddr{Port: tt.port}))
+			rec := httptest.NewRecorder()
+			vh.ServeHTTP(rec, r)
+			if rec.Code != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, rec.Code)
+			}
+			if tt.expected != "" && rec.Body.String() != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestCompileAppsConflicts(t *testing.T) {
+	tests := []struct {
+		name string
+		apps []schema.App
+	}{
+		{
+			name: "same exact host on a shared listener",
+			apps: []schema.App{
+				testApp(t, "a", []string{"shop.example.com"}, 8080),
+				testApp(t, "b", []string{"Shop.Example.com."}, 8080),
+			},
+		},
+		{
+			name: "same wildcard on a shared listener",
+			apps: []schema.App{
+				testApp(t, "a", []string{"*.example.com"}, 8080),
+				testApp(t, "b", []string{"*.example.com"}, 8080, 9090),
+			},
+		},
+		{
+			name: "two apps without hosts on a shared listener",
+			apps: []schema.App{
+				testApp(t, "a", nil, 8080),
+				testApp(t, "b", nil, 8080),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := CompileApps(tt.apps, nil); err == nil {
+				t.Errorf("expected the conflicting hosts to be rejected")
+			}
+		})
+	}
+
+	t.Run("same host on different listeners", func(t *testing.T) {
+		_, err := CompileApps([]schema.App{
+			testApp(t, "a", []string{"shop.example.com"}, 8080),
+			testApp(t, "b", []string{"shop.example.com"}, 9090),
+		}, nil)
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+	})
+}
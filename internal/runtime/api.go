@@ -0,0 +1,171 @@
+package runtime
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/maxcelant/jap/internal/admission"
+	"github.com/maxcelant/jap/internal/schema"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+var errAppNotFound = errors.New("app not found")
+
+// revisionHeader tells which revision of the config a response was read from
+const revisionHeader = "X-Config-Revision"
+
+// appSummary is the entry of an app in the list of apps
+type appSummary struct {
+	Name      string   `json:"name" yaml:"name"`
+	Hosts     []string `json:"hosts,omitempty" yaml:"hosts,omitempty"`
+	Listeners []int    `json:"listeners" yaml:"listeners"`
+	Routes    int      `json:"routes" yaml:"routes"`
+	Sinks     int      `json:"sinks" yaml:"sinks"`
+}
+
+// getConfig returns the config that is currently served. Every app is listed under apps, whether it
+// was sent as the single app or not.
+func (m *serverManager) getConfig(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	cfg := schema.Config{Apps: m.store.List(), Tracing: m.tracing}
+	revision := m.revision
+	m.mu.Unlock()
+	writeObject(w, r, revision, cfg)
+}
+
+// postConfig runs the config through admission like the config file at startup, so that both are
+// defaulted and validated the same way. Its apps are also checked against the running apps they do not
+// replace. A config that is not admitted gets every violation back.
+func (m *serverManager) postConfig(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read body", nil)
+		return
+	}
+	defer r.Body.Close()
+
+	var cfg schema.Config
+	if err := yaml.Unmarshal(body, &cfg); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid yaml: "+err.Error(), nil)
+		return
+	}
+
+	if err := m.admit(&cfg); err != nil {
+		var violations admission.ErrorList
+		if errors.As(err, &violations) {
+			writeError(w, http.StatusBadRequest, "config was not admitted", violations)
+			return
+		}
+		writeError(w, http.StatusBadRequest, "failed to apply config: "+err.Error(), nil)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	log.Info().Msg("updated configuration")
+	w.Write([]byte("successfully updated config\n"))
+}
+
+func (m *serverManager) listApps(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	apps := m.store.List()
+	revision := m.revision
+	m.mu.Unlock()
+	summaries := make([]appSummary, 0, len(apps))
+	for _, app := range apps {
+		summaries = append(summaries, appSummary{
+			Name:      app.Name,
+			Hosts:     app.Hosts,
+			Listeners: app.Listeners,
+			Routes:    len(app.Routes),
+			Sinks:     len(app.Sinks),
+		})
+	}
+	writeObject(w, r, revision, summaries)
+}
+
+func (m *serverManager) getApp(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	app, err := m.store.Get(r.PathValue("name"))
+	revision := m.revision
+	m.mu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusNotFound, errAppNotFound.Error(), nil)
+		return
+	}
+	writeObject(w, r, revision, app)
+}
+
+func (m *serverManager) deleteApp(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	err := m.remove(name)
+	if errors.Is(err, errAppNotFound) {
+		writeError(w, http.StatusNotFound, err.Error(), nil)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to create new handler chain: "+err.Error(), nil)
+		return
+	}
+	log.Info().Str("app", name).Msg("removed app")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// errorResponse is the body of every error of the config API
+type errorResponse struct {
+	Error      string              `json:"error"`
+	Violations admission.ErrorList `json:"violations,omitempty"` // every field that failed admission
+}
+
+func writeError(w http.ResponseWriter, status int, message string, violations admission.ErrorList) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: message, Violations: violations})
+}
+
+// writeObject encodes the object as JSON or YAML, whichever the Accept header prefers. YAML is the
+// default, as it is the format configs are written in.
+func writeObject(w http.ResponseWriter, r *http.Request, revision int, v any) {
+	var (
+		body        []byte
+		err         error
+		contentType string
+	)
+	if acceptsJSON(r.Header.Get("Accept")) {
+		contentType = "application/json"
+		body, err = json.MarshalIndent(v, "", "  ")
+		body = append(body, '\n')
+	} else {
+		contentType = "application/yaml"
+		body, err = yaml.Marshal(v)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to encode config", nil)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set(revisionHeader, strconv.Itoa(revision))
+	w.Write(body)
+}
+
+// acceptsJSON tells whether JSON comes before YAML in the Accept header. Quality values are not
+// weighed, the first of the two media types that is listed wins.
+func acceptsJSON(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/json":
+			return true
+		case "application/yaml", "application/x-yaml", "text/yaml":
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,229 @@
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"gopkg.in/yaml.v3"
+)
+
+func testManager(t *testing.T) (*serverManager, http.Handler) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	m := NewManager(ctx, ManagerOptions{}).(*serverManager)
+	t.Cleanup(func() {
+		cancel()
+		m.workers.Shutdown(context.Background())
+	})
+	// Port 0 binds a free port, so tests do not clash with each other or a running proxy
+	for _, name := range []string{"shop", "blog"} {
+		err := m.upsert([]schema.App{{
+			Name:      name,
+			Hosts:     []string{name + ".example.com"},
+			Listeners: []int{0},
+			Routes:    []schema.Route{{Path: "/", Sink: "backend"}},
+			Sinks:     []schema.Sink{{Name: "backend", Upstreams: []schema.Upstream{{Address: "127.0.0.1", Port: 9}}}},
+		}})
+		if err != nil {
+			t.Fatalf("failed to add app %s: %v", name, err)
+		}
+	}
+	return m, m.master.Handler
+}
+
+func TestGetConfig(t *testing.T) {
+	_, h := testManager(t)
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+		decode      func([]byte, any) error
+	}{
+		{"default", "", "application/yaml", yaml.Unmarshal},
+		{"json", "application/json", "application/json", json.Unmarshal},
+		{"yaml", "application/yaml", "application/yaml", yaml.Unmarshal},
+		{"first listed wins", "text/yaml, application/json", "application/yaml", yaml.Unmarshal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/config", nil)
+			r.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d", w.Code)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != tt.contentType {
+				t.Errorf("expected %s, got %s", tt.contentType, ct)
+			}
+			if rev := w.Header().Get(revisionHeader); rev != "2" {
+				t.Errorf("expected revision 2, got %q", rev)
+			}
+			var cfg schema.Config
+			if err := tt.decode(w.Body.Bytes(), &cfg); err != nil {
+				t.Fatalf("failed to decode the config: %v", err)
+			}
+			if len(cfg.Apps) != 2 || cfg.Apps[0].Name != "shop" || cfg.Apps[1].Name != "blog" {
+				t.Errorf("expected the apps in the order they were added, got %+v", cfg.Apps)
+			}
+			if strings.Contains(w.Body.String(), `"app"`) || strings.HasPrefix(w.Body.String(), "app:") {
+				t.Errorf("expected the empty single app to be left out, got %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestListAndGetApps(t *testing.T) {
+	_, h := testManager(t)
+	r := httptest.NewRequest(http.MethodGet, "/v1/config/apps", nil)
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	var apps []appSummary
+	if err := json.Unmarshal(w.Body.Bytes(), &apps); err != nil {
+		t.Fatalf("failed to decode the apps: %v", err)
+	}
+	if len(apps) != 2 || apps[0].Name != "shop" || apps[0].Routes != 1 || apps[0].Sinks != 1 {
+		t.Errorf("expected a summary of both apps, got %+v", apps)
+	}
+
+	tests := []struct {
+		name   string
+		status int
+	}{
+		{"blog", http.StatusOK},
+		{"missing", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/config/apps/"+tt.name, nil))
+			if w.Code != tt.status {
+				t.Fatalf("expected %d, got %d", tt.status, w.Code)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var app schema.App
+			if err := yaml.Unmarshal(w.Body.Bytes(), &app); err != nil || app.Name != tt.name {
+				t.Errorf("expected app %s, got %+v (%v)", tt.name, app, err)
+			}
+		})
+	}
+}
+
+func TestDeleteApp(t *testing.T) {
+	m, h := testManager(t)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/v1/config/apps/shop", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	apps := m.store.List()
+	if len(apps) != 1 || apps[0].Name != "blog" {
+		t.Errorf("expected only blog to be left, got %+v", apps)
+	}
+	if m.revision != 3 {
+		t.Errorf("expected the delete to be a new revision, got %d", m.revision)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/v1/config/apps/shop", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an app that is gone, got %d", w.Code)
+	}
+}
+
+func TestConfigMethodNotAllowed(t *testing.T) {
+	_, h := testManager(t)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/v1/config", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", w.Code)
+	}
+}
+
+func TestPostConfigViolations(t *testing.T) {
+	m, h := testManager(t)
+	body := `
+app:
+  name: shop
+  listeners: [0]
+  routes:
+  - path: /
+    sink: backend
+  sinks:
+  - name: backend
+    strategy: fastest
+    upstreams:
+    - address: 127.0.0.1
+      port: 70000
+`
+	failures := configReloads.With("failure").Value()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/config", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if got := configReloads.With("failure").Value() - failures; got != 1 {
+		t.Errorf("expected the rejected config to be counted as a failed reload, got %v", got)
+	}
+	var res errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("expected a JSON error, got %q", w.Body.String())
+	}
+	fields := make([]string, len(res.Violations))
+	for i, v := range res.Violations {
+		fields[i] = v.Field
+	}
+	expected := []string{"app.sinks[0].upstreams[0].port", "app.sinks[0].strategy", "app.listeners[0]"}
+	if strings.Join(fields, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected violations at %v, got %v", expected, fields)
+	}
+	if m.revision != 2 {
+		t.Errorf("expected the rejected config not to be applied, got revision %d", m.revision)
+	}
+}
+
+func TestPostConfigConflictsWithRunningApps(t *testing.T) {
+	m, h := testManager(t)
+	port := freePort(t)
+	if err := m.upsert([]schema.App{listenerApp("admin", port)}); err != nil {
+		t.Fatalf("failed to add app: %v", err)
+	}
+	body := fmt.Sprintf(`
+app:
+  name: console
+  hosts: [console.example.com, admin.example.com]
+  listeners: [%d]
+  routes:
+  - path: /
+    sink: backend
+  sinks:
+  - name: backend
+    upstreams:
+    - address: 127.0.0.1
+      port: 9
+`, port)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/config", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	var res errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("expected a JSON error, got %q", w.Body.String())
+	}
+	if len(res.Violations) != 1 || res.Violations[0].Field != "app.hosts[1]" {
+		t.Errorf("expected a single violation at app.hosts[1], got %+v", res.Violations)
+	}
+	if _, err := m.store.Get("console"); err == nil {
+		t.Errorf("expected the conflicting app to not be stored")
+	}
+}
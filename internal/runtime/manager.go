@@ -3,14 +3,20 @@ package runtime
 import (
 	"context"
 	"fmt"
-	"io"
 	"net/http"
+	"slices"
+	"sync"
 	"time"
 
+	"github.com/maxcelant/jap/internal/accesslog"
+	"github.com/maxcelant/jap/internal/admission"
+	"github.com/maxcelant/jap/internal/health"
+	"github.com/maxcelant/jap/internal/metrics"
 	"github.com/maxcelant/jap/internal/routes"
 	"github.com/maxcelant/jap/internal/schema"
+	"github.com/maxcelant/jap/internal/store"
+	"github.com/maxcelant/jap/internal/tracing"
 	"github.com/rs/zerolog/log"
-	"gopkg.in/yaml.v3"
 	"k8s.io/utils/ptr"
 )
 
@@ -24,10 +30,19 @@ type Manager interface {
 }
 
 type serverManager struct {
-	ctx     context.Context
-	handler *dynamicHandler
-	workers runnableGroup
-	master  *http.Server
+	ctx       context.Context
+	handler   *dynamicHandler
+	workers   runnableGroup
+	master    *http.Server
+	endpoints *routes.EndpointRegistry
+	checker   *health.Checker
+
+	// store holds every app that is currently served, in the order they were first configured, and
+	// tracing the tracing config they share. The revision counts the configs that were applied.
+	mu       sync.Mutex
+	store    store.Store
+	tracing  *schema.Tracing
+	revision int
 }
 
 // NewManager creates a new cancellable server manager that manages both the worker group and the config server
@@ -36,9 +51,13 @@ func NewManager(ctx context.Context, opts ManagerOptions) Manager {
 		opts.masterPort = ptr.To(8443)
 	}
 	dh := &dynamicHandler{}
+	endpoints := routes.NewEndpointRegistry()
 	manager := &serverManager{
-		ctx:     ctx,
-		handler: dh,
+		ctx:       ctx,
+		handler:   dh,
+		endpoints: endpoints,
+		checker:   health.NewChecker(ctx, endpoints),
+		store:     store.New(),
 	}
 	manager.workers = NewWorkerGroup(dh)
 	manager.master = func() *http.Server {
@@ -48,38 +67,17 @@ func NewManager(ctx context.Context, opts ManagerOptions) Manager {
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte(`{"status":"ok"}`))
 		})
-		mux.HandleFunc("/v1/config", func(w http.ResponseWriter, r *http.Request) {
-			if r.Method != http.MethodPost {
-				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-				return
-			}
-
-			body, err := io.ReadAll(r.Body)
-			if err != nil {
-				http.Error(w, "failed to read body", http.StatusBadRequest)
-				return
-			}
-			defer r.Body.Close()
-
-			var cfg schema.Config
-			if err := yaml.Unmarshal(body, &cfg); err != nil {
-				http.Error(w, "invalid yaml", http.StatusBadRequest)
-				return
-			}
-
-			h, err := routes.Compile(cfg.App)
-			if err != nil {
-				http.Error(w, "failed to create new handler chain", http.StatusBadRequest)
-				return
-			}
-			dh.reload(h)
-			w.WriteHeader(http.StatusOK)
-			log.Info().Msg("updated configuration")
-			w.Write([]byte("successfully updated config\n"))
-		})
+		mux.Handle("/metrics", metrics.Default.Handler())
+		mux.HandleFunc("GET /v1/config", manager.getConfig)
+		mux.HandleFunc("POST /v1/config", manager.postConfig)
+		mux.HandleFunc("GET /v1/config/apps", manager.listApps)
+		mux.HandleFunc("GET /v1/config/apps/{name}", manager.getApp)
+		mux.HandleFunc("DELETE /v1/config/apps/{name}", manager.deleteApp)
 		return &http.Server{
-			Addr:    fmt.Sprintf(":%d", *opts.masterPort),
-			Handler: mux,
+			Addr:              fmt.Sprintf(":%d", *opts.masterPort),
+			Handler:           mux,
+			ReadHeaderTimeout: defaultReadHeaderTimeout,
+			IdleTimeout:       defaultIdleTimeout,
 		}
 	}()
 
@@ -88,11 +86,12 @@ func NewManager(ctx context.Context, opts ManagerOptions) Manager {
 
 // Start takes the initial configuration so that it can create the handler chain and start the worker group
 func (m *serverManager) Start(initCfg *schema.Config) error {
-	h, err := routes.Compile(initCfg.App)
-	if err != nil {
+	if err := m.configureTracing(initCfg.Tracing); err != nil {
+		return fmt.Errorf("failed to set up tracing: %w", err)
+	}
+	if err := m.upsert(initCfg.AllApps()); err != nil {
 		return fmt.Errorf("failed to load the initial config: %w", err)
 	}
-	m.handler.reload(h)
 	go func() {
 		log.Info().Msgf("starting master server on %s", m.master.Addr)
 		if err := m.master.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -100,7 +99,7 @@ func (m *serverManager) Start(initCfg *schema.Config) error {
 		}
 	}()
 	go func() {
-		if err := m.workers.Start(initCfg.App.Listeners); err != nil && err != http.ErrServerClosed {
+		if err := m.workers.Wait(); err != nil {
 			log.Fatal().Err(err).Msg("worker server failed")
 		}
 	}()
@@ -109,6 +108,154 @@ func (m *serverManager) Start(initCfg *schema.Config) error {
 	return nil
 }
 
+// upsert replaces the apps that share a name with one of the given apps and adds the rest
+func (m *serverManager) upsert(apps []schema.App) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reload(m.merge(apps))
+}
+
+// admit runs the config through admission against the apps that are running and applies it. All of it
+// happens under m.mu, so that no other update can claim a listener or host in between. The tracer of
+// the config is built before its apps are applied and only used once they are, so that a config is
+// either applied as a whole or not at all.
+func (m *serverManager) admit(cfg *schema.Config) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := admission.AdmitUpdate(cfg, m.store.List()); err != nil {
+		configReloads.With("failure").Inc()
+		return err
+	}
+	// Tracing is only replaced when the config sets it, like apps that are left out keep running
+	var tracer *tracing.Tracer
+	if cfg.Tracing != nil {
+		var err error
+		if tracer, err = tracing.New(*cfg.Tracing); err != nil {
+			configReloads.With("failure").Inc()
+			return fmt.Errorf("failed to set up tracing: %w", err)
+		}
+	}
+	if err := m.reload(m.merge(cfg.AllApps())); err != nil {
+		if tracer != nil {
+			go tracer.Shutdown(context.Background())
+		}
+		return err
+	}
+	if tracer != nil {
+		tracing.Use(tracer)
+		m.tracing = cfg.Tracing
+	}
+	return nil
+}
+
+// merge replaces the running apps with the apps of the same name and adds the new ones after them.
+// The caller must hold m.mu.
+func (m *serverManager) merge(apps []schema.App) []schema.App {
+	merged := m.store.List()
+	for _, app := range apps {
+		if i := slices.IndexFunc(merged, func(a schema.App) bool { return a.Name == app.Name }); i >= 0 {
+			merged[i] = app
+			continue
+		}
+		merged = append(merged, app)
+	}
+	return merged
+}
+
+// remove stops serving the app with the name
+func (m *serverManager) remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	apps := m.store.List()
+	i := slices.IndexFunc(apps, func(a schema.App) bool { return a.Name == name })
+	if i < 0 {
+		return errAppNotFound
+	}
+	return m.reload(slices.Delete(apps, i, i+1))
+}
+
+// reload applies the apps and counts the outcome. The caller must hold m.mu.
+func (m *serverManager) reload(apps []schema.App) error {
+	if err := m.apply(apps); err != nil {
+		configReloads.With("failure").Inc()
+		return err
+	}
+	m.revision++
+	configReloads.With("success").Inc()
+	configRevision.With().Set(float64(m.revision))
+	configReloadTime.With().Set(float64(time.Now().Unix()))
+	return nil
+}
+
+// configureTracing replaces the tracing config of every app
+func (m *serverManager) configureTracing(cfg *schema.Tracing) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := tracing.Configure(cfg); err != nil {
+		return err
+	}
+	m.tracing = cfg
+	return nil
+}
+
+// apply compiles the apps into a new handler chain and swaps it in, starting a worker on any listener
+// that is not served yet and stopping the workers of listeners no app uses anymore. The first app to
+// claim a listener decides its timeouts. When a listener cannot be bound, the ones bound for the apps
+// are closed again and nothing changes. The health checker is synced with the apps afterwards so that
+// unchanged upstreams keep their probes and state, and the access log files no app writes to anymore
+// are closed.
+// The caller must hold m.mu.
+func (m *serverManager) apply(apps []schema.App) error {
+	h, err := routes.CompileApps(apps, m.endpoints)
+	if err != nil {
+		return err
+	}
+	serving := m.workers.Ports()
+	var started, wanted []int
+	for _, app := range apps {
+		for _, port := range app.Listeners {
+			wanted = append(wanted, port)
+			if slices.Contains(serving, port) || slices.Contains(started, port) {
+				continue
+			}
+			if err := m.workers.Listen(port, app.ListenerTimeouts); err != nil {
+				for _, p := range started {
+					m.workers.Close(p)
+				}
+				return err
+			}
+			started = append(started, port)
+		}
+	}
+	m.handler.reload(h)
+	for _, port := range serving {
+		if !slices.Contains(wanted, port) {
+			m.workers.Close(port)
+		}
+	}
+	var logPaths []string
+	for _, app := range apps {
+		m.checker.Sync(app)
+		m.endpoints.Prune(app)
+		if app.AccessLog != nil && app.AccessLog.Path != nil {
+			logPaths = append(logPaths, *app.AccessLog.Path)
+		}
+	}
+	accesslog.CloseUnused(logPaths)
+	// An app that is gone is synced as an empty app, which stops its probes and drops its endpoints
+	for _, old := range m.store.List() {
+		if !slices.ContainsFunc(apps, func(a schema.App) bool { return a.Name == old.Name }) {
+			m.checker.Sync(schema.App{Name: old.Name})
+			m.endpoints.Prune(schema.App{Name: old.Name})
+			m.store.Del(old.Name)
+		}
+	}
+	for _, app := range apps {
+		m.store.Set(app.Name, app)
+	}
+	return nil
+}
+
 // Stop gracefully shuts down the config server and the worker group
 func (m *serverManager) Stop() error {
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -120,6 +267,10 @@ func (m *serverManager) Stop() error {
 	if err := m.workers.Shutdown(shutdownCtx); err != nil {
 		return fmt.Errorf("failed to shut down worker server: %w", err)
 	}
+	// The workers are done, so every span is finished and can be sent
+	if err := tracing.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to flush spans: %w", err)
+	}
 	return nil
 
 }
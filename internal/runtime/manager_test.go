@@ -0,0 +1,106 @@
+package runtime
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"github.com/maxcelant/jap/internal/tracing"
+)
+
+// freePort finds a port that nothing listens on
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func listening(port int) bool {
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func listenerApp(name string, ports ...int) schema.App {
+	return schema.App{
+		Name:      name,
+		Hosts:     []string{name + ".example.com"},
+		Listeners: ports,
+		Routes:    []schema.Route{{Path: "/", Sink: "backend"}},
+		Sinks:     []schema.Sink{{Name: "backend", Upstreams: []schema.Upstream{{Address: "127.0.0.1", Port: 9}}}},
+	}
+}
+
+func TestListeners(t *testing.T) {
+	m, _ := testManager(t)
+
+	t.Run("removing an app closes the listeners only it used", func(t *testing.T) {
+		port := freePort(t)
+		if err := m.upsert([]schema.App{listenerApp("admin", port)}); err != nil {
+			t.Fatalf("failed to add app: %v", err)
+		}
+		if !listening(port) {
+			t.Fatalf("expected port %d to accept connections", port)
+		}
+		if err := m.remove("admin"); err != nil {
+			t.Fatalf("failed to remove app: %v", err)
+		}
+		if listening(port) {
+			t.Errorf("expected port %d to be closed once its app was removed", port)
+		}
+	})
+
+	t.Run("a listener that cannot be bound rolls back the others", func(t *testing.T) {
+		taken, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Fatalf("failed to take a port: %v", err)
+		}
+		defer taken.Close()
+		port := freePort(t)
+		err = m.upsert([]schema.App{listenerApp("admin", port, taken.Addr().(*net.TCPAddr).Port)})
+		if err == nil {
+			t.Fatalf("expected the taken port to fail the update")
+		}
+		if listening(port) {
+			t.Errorf("expected port %d to be closed again after the failed update", port)
+		}
+		if _, err := m.store.Get("admin"); err == nil {
+			t.Errorf("expected the app of the failed update to not be stored")
+		}
+	})
+}
+
+func TestAdmitAppliesTracingWithTheApps(t *testing.T) {
+	m, _ := testManager(t)
+	t.Cleanup(func() { tracing.Shutdown(context.Background()) })
+	taken, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to take a port: %v", err)
+	}
+	defer taken.Close()
+	collector := &schema.Tracing{Endpoint: "http://127.0.0.1:4318/v1/traces"}
+
+	err = m.admit(&schema.Config{App: listenerApp("admin", taken.Addr().(*net.TCPAddr).Port), Tracing: collector})
+	if err == nil {
+		t.Fatalf("expected the taken port to fail the update")
+	}
+	if _, span := tracing.Start(context.Background(), "test", tracing.KindInternal); span != nil || m.tracing != nil {
+		t.Errorf("expected tracing to be left alone when the apps were not applied")
+	}
+
+	if err := m.admit(&schema.Config{App: listenerApp("admin", freePort(t)), Tracing: collector}); err != nil {
+		t.Fatalf("failed to apply the config: %v", err)
+	}
+	if _, span := tracing.Start(context.Background(), "test", tracing.KindInternal); span == nil || m.tracing != collector {
+		t.Errorf("expected tracing to be set up along with the apps")
+	}
+}
@@ -0,0 +1,19 @@
+package runtime
+
+import "github.com/maxcelant/jap/internal/metrics"
+
+var (
+	configReloads = metrics.Default.Counter("jap_config_reloads_total",
+		"Config reloads, by whether the new config was applied or rejected.",
+		"result")
+	configRevision = metrics.Default.Gauge("jap_config_revision",
+		"Revision of the config being served, counting up from 1 with every applied config.")
+	configReloadTime = metrics.Default.Gauge("jap_config_last_reload_success_timestamp_seconds",
+		"Unix time of the last applied config.")
+)
+
+func init() {
+	// Both results are exported from the start, so that a first failure shows up as an increase
+	configReloads.With("success")
+	configReloads.With("failure")
+}
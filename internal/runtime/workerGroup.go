@@ -4,67 +4,146 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"sync"
+	"time"
 
+	"github.com/maxcelant/jap/internal/schema"
 	"github.com/rs/zerolog/log"
+	"k8s.io/utils/ptr"
 )
 
 type runnableGroup interface {
-	Start([]int) error
+	Listen(int, *schema.ListenerTimeouts) error
+	Close(int)
+	Ports() []int
+	Wait() error
 	Shutdown(context.Context) error
 }
 
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+	// closeTimeout is how long the requests on a closed listener get to finish
+	closeTimeout = 30 * time.Second
+)
+
 type workerGroup struct {
-	workers []*http.Server
 	handler *dynamicHandler
 
-	wg   sync.WaitGroup
-	once sync.Once
+	mu      sync.Mutex
+	workers map[int]*worker
+	errs    []error
+	wg      sync.WaitGroup
+}
+
+type worker struct {
+	*http.Server
+	ln *closeNotifyListener
+}
+
+// closeNotifyListener tells when the server is done accepting connections on it
+type closeNotifyListener struct {
+	net.Listener
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (l *closeNotifyListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(func() { close(l.closed) })
+	return err
 }
 
 func NewWorkerGroup(dh *dynamicHandler) runnableGroup {
 	return &workerGroup{
 		handler: dh,
-		workers: make([]*http.Server, 0),
+		workers: make(map[int]*worker),
 	}
 }
 
-func (g *workerGroup) Start(listeners []int) error {
-	// Create a http server for every listener port
-	for _, addr := range listeners {
-		g.workers = append(g.workers, &http.Server{Handler: g.handler, Addr: fmt.Sprintf(":%d", addr)})
+// Listen starts a worker server on the port unless one is already running there. The timeouts only
+// apply to a new server, a running one keeps the timeouts it was started with.
+func (g *workerGroup) Listen(port int, timeouts *schema.ListenerTimeouts) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.workers[port]; ok {
+		return nil
+	}
+	t := ptr.Deref(timeouts, schema.ListenerTimeouts{})
+	server := &http.Server{
+		Handler:           g.handler,
+		Addr:              fmt.Sprintf(":%d", port),
+		ReadTimeout:       time.Duration(ptr.Deref(t.Read, 0)),
+		ReadHeaderTimeout: time.Duration(ptr.Deref(t.ReadHeader, schema.Duration(defaultReadHeaderTimeout))),
+		WriteTimeout:      time.Duration(ptr.Deref(t.Write, 0)),
+		IdleTimeout:       time.Duration(ptr.Deref(t.Idle, schema.Duration(defaultIdleTimeout))),
 	}
-	errCh := make(chan error, len(g.workers))
-	// Start all the servers
-	g.once.Do(func() {
-		g.wg.Add(len(g.workers))
-		for _, worker := range g.workers {
-			go func() {
-				defer g.wg.Done()
-				// ListenAndServe will block until signalled by the Stop method
-				log.Info().Msgf("starting worker server on %s", worker.Addr)
-				if err := worker.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-					errCh <- err
-				}
-			}()
+	// Bind right away so that a port that is already taken is reported to the caller
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", server.Addr, err)
+	}
+	w := &worker{server, &closeNotifyListener{Listener: ln, closed: make(chan struct{})}}
+	g.workers[port] = w
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		// Serve will block until signalled by the Shutdown method
+		log.Info().Msgf("starting worker server on %s", w.Addr)
+		if err := w.Serve(w.ln); err != nil && err != http.ErrServerClosed {
+			g.mu.Lock()
+			g.errs = append(g.errs, err)
+			g.mu.Unlock()
 		}
-	})
-	g.wg.Wait()
-	close(errCh)
+	}()
+	return nil
+}
 
-	var errList []error
-	for err := range errCh {
-		errList = append(errList, err)
+// Close stops the worker server on the port. It returns once the port no longer accepts connections,
+// the requests that are still being served get closeTimeout to finish in the background.
+func (g *workerGroup) Close(port int) {
+	g.mu.Lock()
+	w, ok := g.workers[port]
+	delete(g.workers, port)
+	g.mu.Unlock()
+	if !ok {
+		return
 	}
+	log.Info().Msgf("stopping worker server on %s", w.Addr)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+		defer cancel()
+		if err := w.Shutdown(ctx); err != nil {
+			log.Warn().Err(err).Msgf("worker server on %s did not stop in time", w.Addr)
+		}
+	}()
+	<-w.ln.closed
+}
 
-	if len(errList) != 0 {
-		return errors.Join(errList...)
+// Ports lists the ports that worker servers are listening on
+func (g *workerGroup) Ports() []int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ports := make([]int, 0, len(g.workers))
+	for port := range g.workers {
+		ports = append(ports, port)
 	}
-	return nil
+	return ports
+}
+
+// Wait blocks until every worker server has stopped
+func (g *workerGroup) Wait() error {
+	g.wg.Wait()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return errors.Join(g.errs...)
 }
 
 func (g *workerGroup) Shutdown(shutdownCtx context.Context) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 	var errList []error
 	for _, worker := range g.workers {
 		if err := worker.Shutdown(shutdownCtx); err != nil {
@@ -1,30 +1,247 @@
 package schema
 
+import "reflect"
+
 type Config struct {
 	// TODO: add metadata object here
-	App App `json:"app" yaml:"app"`
+	App  App   `json:"app,omitzero" yaml:"app,omitempty"`
+	Apps []App `json:"apps,omitempty" yaml:"apps,omitempty"` // more apps, possibly sharing listeners with each other
+	// Tracing is shared by every app, since spans of one request can cross apps through their upstreams
+	Tracing *Tracing `json:"tracing,omitempty" yaml:"tracing,omitempty"`
+}
+
+// AllApps returns the single app followed by the list of apps, whichever of the two are set
+func (c Config) AllApps() []App {
+	var apps []App
+	if !reflect.ValueOf(c.App).IsZero() {
+		apps = append(apps, c.App)
+	}
+	return append(apps, c.Apps...)
 }
 
 type Listener string
 
 type App struct {
-	Name      string  `json:"name" yaml:"name"`
-	Listeners []int   `json:"listeners" yaml:"listeners"`
-	Routes    []Route `json:"routes" yaml:"routes"`
-	Sinks     []Sink  `json:"sinks" yaml:"sinks"`
+	Name             string            `json:"name" yaml:"name"`
+	Hosts            []string          `json:"hosts,omitempty" yaml:"hosts,omitempty"` // exact or wildcard (*.example.com) hosts, an app without hosts gets every other host
+	Listeners        []int             `json:"listeners" yaml:"listeners"`
+	ListenerTimeouts *ListenerTimeouts `json:"listenerTimeouts,omitempty" yaml:"listenerTimeouts,omitempty"`
+	AccessLog        *AccessLog        `json:"accessLog,omitempty" yaml:"accessLog,omitempty"` // a plain log line per request by default
+	Routes           []Route           `json:"routes" yaml:"routes"`
+	Sinks            []Sink            `json:"sinks" yaml:"sinks"`
+}
+
+// ListenerTimeouts are the server side timeouts of every listener of the app
+type ListenerTimeouts struct {
+	Read       *Duration `json:"read,omitempty" yaml:"read,omitempty"`             // reading the whole request, no timeout by default
+	ReadHeader *Duration `json:"readHeader,omitempty" yaml:"readHeader,omitempty"` // reading the request headers, defaults to 10s
+	Write      *Duration `json:"write,omitempty" yaml:"write,omitempty"`           // writing the response, no timeout by default
+	Idle       *Duration `json:"idle,omitempty" yaml:"idle,omitempty"`             // keep-alive connections waiting for the next request, defaults to 2m
 }
 
 type Route struct {
-	Path    string    `json:"path" yaml:"path"`
-	Methods *[]string `json:"methods,omitempty" yaml:"methods,omitempty"`
-	Match   *string   `json:"match,omitempty" yaml:"match,omitempty"` // exact | prefix | regex, defaults to exact
-	Sink    string    `json:"sink" yaml:"sink"`
+	Name        string        `json:"name,omitempty" yaml:"name,omitempty"` // identifies the route in logs and header variables, the path by default
+	Path        string        `json:"path" yaml:"path"`
+	Methods     *[]string     `json:"methods,omitempty" yaml:"methods,omitempty"`
+	Match       *string       `json:"match,omitempty" yaml:"match,omitempty"` // exact | prefix | regex, defaults to exact
+	Headers     []HeaderMatch `json:"headers,omitempty" yaml:"headers,omitempty"`
+	QueryParams []ValueMatch  `json:"queryParams,omitempty" yaml:"queryParams,omitempty"`
+	Cookies     []ValueMatch  `json:"cookies,omitempty" yaml:"cookies,omitempty"`
+	// Exactly one of sink, sinks, redirect or directResponse is the action of the route
+	Sink            string          `json:"sink,omitempty" yaml:"sink,omitempty"`
+	Sinks           []WeightedSink  `json:"sinks,omitempty" yaml:"sinks,omitempty"`
+	Sticky          *HashPolicy     `json:"sticky,omitempty" yaml:"sticky,omitempty"` // keeps a client on the same one of the sinks, random by default
+	Redirect        *Redirect       `json:"redirect,omitempty" yaml:"redirect,omitempty"`
+	DirectResponse  *DirectResponse `json:"directResponse,omitempty" yaml:"directResponse,omitempty"`
+	Retries         *RetryPolicy    `json:"retries,omitempty" yaml:"retries,omitempty"`
+	Timeout         *Duration       `json:"timeout,omitempty" yaml:"timeout,omitempty"`         // bounds the whole request including retries, no timeout by default
+	IdleTimeout     *Duration       `json:"idleTimeout,omitempty" yaml:"idleTimeout,omitempty"` // how long the upstream may go without sending anything, no timeout by default
+	Rewrite         *Rewrite        `json:"rewrite,omitempty" yaml:"rewrite,omitempty"`
+	Mirror          *Mirror         `json:"mirror,omitempty" yaml:"mirror,omitempty"`
+	Faults          *Faults         `json:"faults,omitempty" yaml:"faults,omitempty"`
+	AccessLog       *RouteAccessLog `json:"accessLog,omitempty" yaml:"accessLog,omitempty"`
+	RequestHeaders  *HeaderOps      `json:"requestHeaders,omitempty" yaml:"requestHeaders,omitempty"`   // applied to the request sent upstream, after the ones of the sink
+	ResponseHeaders *HeaderOps      `json:"responseHeaders,omitempty" yaml:"responseHeaders,omitempty"` // applied to the upstream response, after the ones of the sink
+}
+
+// AccessLog configures the access log lines of an app
+type AccessLog struct {
+	Format     *string `json:"format,omitempty" yaml:"format,omitempty"`         // json | combined | template, defaults to json
+	Template   *string `json:"template,omitempty" yaml:"template,omitempty"`     // the line of the template format, e.g. "${method} ${path} ${status}"
+	Path       *string `json:"path,omitempty" yaml:"path,omitempty"`             // the file to write to, stdout by default
+	MaxSizeMB  *int    `json:"maxSizeMB,omitempty" yaml:"maxSizeMB,omitempty"`   // size at which the file is rotated, defaults to 100
+	MaxBackups *int    `json:"maxBackups,omitempty" yaml:"maxBackups,omitempty"` // rotated files that are kept, defaults to 5
+}
+
+// Tracing exports the spans of requests to an OpenTelemetry collector over OTLP/HTTP
+type Tracing struct {
+	Endpoint      string    `json:"endpoint" yaml:"endpoint"`                               // the traces URL of the collector, e.g. http://localhost:4318/v1/traces
+	ServiceName   *string   `json:"serviceName,omitempty" yaml:"serviceName,omitempty"`     // defaults to jap
+	SampleRatio   *float64  `json:"sampleRatio,omitempty" yaml:"sampleRatio,omitempty"`     // share of new traces that is recorded, from 0 to 1, defaults to 1
+	FlushInterval *Duration `json:"flushInterval,omitempty" yaml:"flushInterval,omitempty"` // how often finished spans are sent, defaults to 5s
+}
+
+// RouteAccessLog samples or disables the access log lines of a route
+type RouteAccessLog struct {
+	Disabled bool     `json:"disabled,omitempty" yaml:"disabled,omitempty"`
+	Percent  *float64 `json:"percent,omitempty" yaml:"percent,omitempty"` // share of the requests that is logged, defaults to 100
+}
+
+// HeaderOps changes headers. Headers are removed first, then set and then added to. Values may use the
+// variables ${client_ip}, ${route}, ${upstream} and ${request_id}.
+type HeaderOps struct {
+	Set    map[string]string `json:"set,omitempty" yaml:"set,omitempty"` // replaces any existing values
+	Add    map[string]string `json:"add,omitempty" yaml:"add,omitempty"` // keeps any existing values
+	Remove []string          `json:"remove,omitempty" yaml:"remove,omitempty"`
+}
+
+// Faults injects delays and aborts into the requests of a route for chaos testing
+type Faults struct {
+	Header *HeaderMatch `json:"header,omitempty" yaml:"header,omitempty"` // only requests matching the header get faults, every request by default
+	Delay  *FaultDelay  `json:"delay,omitempty" yaml:"delay,omitempty"`
+	Abort  *FaultAbort  `json:"abort,omitempty" yaml:"abort,omitempty"`
+}
+
+// FaultDelay holds requests back before they are handled, either for a fixed time or for a random time between min and max
+type FaultDelay struct {
+	Percent *float64  `json:"percent,omitempty" yaml:"percent,omitempty"` // share of the requests that is delayed, defaults to 100
+	Fixed   *Duration `json:"fixed,omitempty" yaml:"fixed,omitempty"`
+	Min     *Duration `json:"min,omitempty" yaml:"min,omitempty"`
+	Max     *Duration `json:"max,omitempty" yaml:"max,omitempty"`
+}
+
+// FaultAbort fails requests instead of handling them, exactly one of status or reset should be set
+type FaultAbort struct {
+	Percent *float64 `json:"percent,omitempty" yaml:"percent,omitempty"` // share of the requests that is aborted, defaults to 100
+	Status  *int     `json:"status,omitempty" yaml:"status,omitempty"`
+	Reset   bool     `json:"reset,omitempty" yaml:"reset,omitempty"` // drops the connection without a response
+}
+
+// Mirror sends a copy of the requests of a route to another sink and ignores its responses
+type Mirror struct {
+	Sink             string   `json:"sink" yaml:"sink"`
+	Percent          *float64 `json:"percent,omitempty" yaml:"percent,omitempty"`                   // share of the requests that is mirrored, defaults to 100
+	BufferLimitBytes *int64   `json:"bufferLimitBytes,omitempty" yaml:"bufferLimitBytes,omitempty"` // requests with larger bodies are not mirrored, defaults to 64KiB
+}
+
+// WeightedSink is one of the sinks a route splits its traffic over
+type WeightedSink struct {
+	Name   string `json:"name" yaml:"name"`
+	Weight int    `json:"weight" yaml:"weight"` // relative to the weights of the other sinks of the route
+}
+
+// Redirect answers with a redirect to the request URL with some of its parts replaced
+type Redirect struct {
+	Scheme     *string `json:"scheme,omitempty" yaml:"scheme,omitempty"`         // http | https, the request scheme by default
+	Host       *string `json:"host,omitempty" yaml:"host,omitempty"`             // the request host by default
+	Port       *int    `json:"port,omitempty" yaml:"port,omitempty"`             // the request port by default
+	Path       *string `json:"path,omitempty" yaml:"path,omitempty"`             // may use ${path} and the capture groups of a regex route, the request path by default
+	StripQuery bool    `json:"stripQuery,omitempty" yaml:"stripQuery,omitempty"` // drops the query of the request
+	Status     *int    `json:"status,omitempty" yaml:"status,omitempty"`         // 301 | 302 | 307 | 308, defaults to 301
+}
+
+// DirectResponse answers the request itself, at most one of body or bodyFile should be set
+type DirectResponse struct {
+	Status   int               `json:"status" yaml:"status"`
+	Headers  map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Body     *string           `json:"body,omitempty" yaml:"body,omitempty"`
+	BodyFile *string           `json:"bodyFile,omitempty" yaml:"bodyFile,omitempty"` // read once when the config is loaded
+}
+
+// Rewrite changes the request before it is sent upstream, at most one of the path rewrites should be set
+type Rewrite struct {
+	StripPrefix       *string `json:"stripPrefix,omitempty" yaml:"stripPrefix,omitempty"`             // removed from the start of the path
+	ReplacePrefix     *string `json:"replacePrefix,omitempty" yaml:"replacePrefix,omitempty"`         // replaces the path prefix of a prefix route
+	RegexSubstitution *string `json:"regexSubstitution,omitempty" yaml:"regexSubstitution,omitempty"` // replaces the matches of the path of a regex route, may use $1 or ${name}
+	Host              *string `json:"host,omitempty" yaml:"host,omitempty"`                           // the Host header sent upstream, the client's host by default
+}
+
+// HeaderMatch matches a request header, exactly one of exact, prefix, regex or present should be set
+type HeaderMatch struct {
+	Name    string  `json:"name" yaml:"name"`
+	Exact   *string `json:"exact,omitempty" yaml:"exact,omitempty"`
+	Prefix  *string `json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	Regex   *string `json:"regex,omitempty" yaml:"regex,omitempty"`
+	Present *bool   `json:"present,omitempty" yaml:"present,omitempty"` // true matches when the header is set, false when it is absent
+	Invert  bool    `json:"invert,omitempty" yaml:"invert,omitempty"`
+}
+
+// ValueMatch matches a query parameter or a cookie, exactly one of exact, regex or present should be set
+type ValueMatch struct {
+	Name    string  `json:"name" yaml:"name"`
+	Exact   *string `json:"exact,omitempty" yaml:"exact,omitempty"`
+	Regex   *string `json:"regex,omitempty" yaml:"regex,omitempty"`
+	Present *bool   `json:"present,omitempty" yaml:"present,omitempty"` // true matches when it is set, false when it is absent
+}
+
+// RetryPolicy retries failed requests, every attempt goes to a different upstream of the sink when possible
+type RetryPolicy struct {
+	Attempts           *int      `json:"attempts,omitempty" yaml:"attempts,omitempty"`                     // total attempts including the first, defaults to 2
+	RetryOn            []string  `json:"retryOn,omitempty" yaml:"retryOn,omitempty"`                       // connect-failure | reset | 5xx | a status code, defaults to connect-failure, 502, 503 and 504
+	PerTryTimeout      *Duration `json:"perTryTimeout,omitempty" yaml:"perTryTimeout,omitempty"`           // no timeout by default
+	Backoff            *Backoff  `json:"backoff,omitempty" yaml:"backoff,omitempty"`                       // defaults to 25ms base and 250ms max
+	RetryNonIdempotent bool      `json:"retryNonIdempotent,omitempty" yaml:"retryNonIdempotent,omitempty"` // only idempotent methods are retried by default
+	BufferLimitBytes   *int64    `json:"bufferLimitBytes,omitempty" yaml:"bufferLimitBytes,omitempty"`     // larger request bodies are not retried, defaults to 64KiB
+}
+
+// Backoff is an exponential backoff with full jitter, the wait before retry n (counting from 1) is
+// random between 0 and min(maxInterval, baseInterval * 2^(n-1))
+type Backoff struct {
+	BaseInterval *Duration `json:"baseInterval,omitempty" yaml:"baseInterval,omitempty"`
+	MaxInterval  *Duration `json:"maxInterval,omitempty" yaml:"maxInterval,omitempty"`
 }
 
 type Sink struct {
-	Name      string     `json:"name" yaml:"name"`
-	Strategy  *string    `json:"strategy,omitempty" yaml:"strategy,omitempty"`
-	Upstreams []Upstream `json:"upstreams" yaml:"upstreams"`
+	Name             string            `json:"name" yaml:"name"`
+	Strategy         *string           `json:"strategy,omitempty" yaml:"strategy,omitempty"`
+	Hash             *HashPolicy       `json:"hash,omitempty" yaml:"hash,omitempty"` // only used by the hash strategy
+	HealthCheck      *HealthCheck      `json:"healthCheck,omitempty" yaml:"healthCheck,omitempty"`
+	OutlierDetection *OutlierDetection `json:"outlierDetection,omitempty" yaml:"outlierDetection,omitempty"`
+	CircuitBreaker   *CircuitBreaker   `json:"circuitBreaker,omitempty" yaml:"circuitBreaker,omitempty"`
+	RequestHeaders   *HeaderOps        `json:"requestHeaders,omitempty" yaml:"requestHeaders,omitempty"`
+	ResponseHeaders  *HeaderOps        `json:"responseHeaders,omitempty" yaml:"responseHeaders,omitempty"`
+	Upstreams        []Upstream        `json:"upstreams" yaml:"upstreams"`
+}
+
+// HashPolicy picks the part of the request that the hash strategy uses as its key, exactly one should be set
+type HashPolicy struct {
+	Header     *string `json:"header,omitempty" yaml:"header,omitempty"`
+	Cookie     *string `json:"cookie,omitempty" yaml:"cookie,omitempty"`
+	QueryParam *string `json:"queryParam,omitempty" yaml:"queryParam,omitempty"`
+	SourceIP   bool    `json:"sourceIP,omitempty" yaml:"sourceIP,omitempty"`
+}
+
+// HealthCheck actively probes every upstream of a sink, upstreams that fail are taken out of rotation
+// until they pass again
+type HealthCheck struct {
+	Path               string       `json:"path" yaml:"path"`
+	ExpectedStatuses   *StatusRange `json:"expectedStatuses,omitempty" yaml:"expectedStatuses,omitempty"` // defaults to 200-299
+	Interval           *Duration    `json:"interval,omitempty" yaml:"interval,omitempty"`
+	Timeout            *Duration    `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	HealthyThreshold   *int         `json:"healthyThreshold,omitempty" yaml:"healthyThreshold,omitempty"`     // consecutive passes to become healthy
+	UnhealthyThreshold *int         `json:"unhealthyThreshold,omitempty" yaml:"unhealthyThreshold,omitempty"` // consecutive failures to become unhealthy
+}
+
+// StatusRange is an inclusive range of HTTP status codes
+type StatusRange struct {
+	Min int `json:"min" yaml:"min"`
+	Max int `json:"max" yaml:"max"`
+}
+
+// OutlierDetection passively watches the responses of every upstream of a sink, upstreams that keep failing are
+// ejected for a period that doubles every time they are ejected again
+type OutlierDetection struct {
+	ConsecutiveErrors  *int      `json:"consecutiveErrors,omitempty" yaml:"consecutiveErrors,omitempty"`   // connection errors and 5xx responses before ejection, defaults to 5
+	BaseEjectionTime   *Duration `json:"baseEjectionTime,omitempty" yaml:"baseEjectionTime,omitempty"`     // defaults to 30s
+	MaxEjectionTime    *Duration `json:"maxEjectionTime,omitempty" yaml:"maxEjectionTime,omitempty"`       // defaults to 5m
+	MaxEjectionPercent *int      `json:"maxEjectionPercent,omitempty" yaml:"maxEjectionPercent,omitempty"` // defaults to 50
+}
+
+// CircuitBreaker caps the load a sink may receive, requests over the limits fail fast instead of piling up
+type CircuitBreaker struct {
+	MaxRequests        *int `json:"maxRequests,omitempty" yaml:"maxRequests,omitempty"`               // concurrent requests to the sink, defaults to 1024
+	MaxPendingRequests *int `json:"maxPendingRequests,omitempty" yaml:"maxPendingRequests,omitempty"` // requests waiting for one of those slots, defaults to 1024
+	MaxRetries         *int `json:"maxRetries,omitempty" yaml:"maxRetries,omitempty"`                 // concurrent retries to the sink, defaults to 3
 }
 
 type Upstream struct {
@@ -2,6 +2,8 @@ package store
 
 import (
 	"fmt"
+	"slices"
+	"sync"
 
 	"github.com/maxcelant/jap/internal/schema"
 	"github.com/maxcelant/jap/pkg/cache"
@@ -15,10 +17,17 @@ import (
 type Store interface {
 	Get(string) (*schema.App, error)
 	Set(string, schema.App)
+	Del(string)
+	// List returns copies of every stored object in the order they were first set
+	List() []schema.App
 }
 
 type configStore struct {
 	c cache.Cache[*schema.App]
+
+	// names keeps the order of the objects, which the cache does not
+	mu    sync.Mutex
+	names []string
 }
 
 func New() Store {
@@ -27,7 +36,7 @@ func New() Store {
 	}
 }
 
-func (cs configStore) Get(name string) (*schema.App, error) {
+func (cs *configStore) Get(name string) (*schema.App, error) {
 	app, ok := cs.c.Get(name)
 	if !ok {
 		return nil, fmt.Errorf("failed to find request config object %s", name)
@@ -38,5 +47,29 @@ func (cs configStore) Get(name string) (*schema.App, error) {
 // Set stores a copy of an object. This ensures that mutations to the original after this call
 // do _not_ affect the stored object.
 func (cs *configStore) Set(name string, obj schema.App) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, ok := cs.c.Get(name); !ok {
+		cs.names = append(cs.names, name)
+	}
 	cs.c.Set(name, &obj)
 }
+
+func (cs *configStore) Del(name string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.names = slices.DeleteFunc(cs.names, func(n string) bool { return n == name })
+	cs.c.Del(name)
+}
+
+func (cs *configStore) List() []schema.App {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	apps := make([]schema.App, 0, len(cs.names))
+	for _, name := range cs.names {
+		if app, ok := cs.c.Get(name); ok {
+			apps = append(apps, *app)
+		}
+	}
+	return apps
+}
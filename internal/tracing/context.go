@@ -0,0 +1,131 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+)
+
+// The W3C trace context headers
+const (
+	traceparentHeader = "Traceparent"
+	tracestateHeader  = "Tracestate"
+)
+
+const flagSampled = 0x01
+
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// SpanContext is the part of a span that is propagated to other services
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Sampled    bool
+	TraceState string // passed on as it is, the proxy does not add an entry of its own
+}
+
+func (sc SpanContext) valid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// traceparent formats the context as a version 00 traceparent header
+func (sc SpanContext) traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// parseTraceparent parses a traceparent header. Versions after 00 are parsed as far as they are
+// known, as the spec asks, while the invalid version ff and all-zero IDs are rejected.
+func parseTraceparent(s string) (SpanContext, bool) {
+	var sc SpanContext
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return sc, false
+	}
+	version, ok := decodeHex(s[0:2])
+	if !ok || version[0] == 0xff || (version[0] == 0 && len(s) != 55) || (len(s) > 55 && s[55] != '-') {
+		return sc, false
+	}
+	traceID, ok := decodeHex(s[3:35])
+	if !ok {
+		return sc, false
+	}
+	spanID, ok := decodeHex(s[36:52])
+	if !ok {
+		return sc, false
+	}
+	flags, ok := decodeHex(s[53:55])
+	if !ok {
+		return sc, false
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Sampled = flags[0]&flagSampled != 0
+	return sc, sc.valid()
+}
+
+// decodeHex only accepts lowercase hex, which is all the spec allows
+func decodeHex(s string) ([]byte, bool) {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return nil, false
+		}
+	}
+	b, err := hex.DecodeString(s)
+	return b, err == nil
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+// Extract returns a context carrying the span context of the headers, which becomes the parent of the
+// next span that is started. Missing or invalid headers leave the context alone, so that a new trace
+// is started instead.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	sc, ok := parseTraceparent(h.Get(traceparentHeader))
+	if !ok {
+		return ctx
+	}
+	sc.TraceState = h.Get(tracestateHeader)
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Inject sets the trace context headers to the span of the context. Without a span the headers are
+// left as they are.
+func Inject(ctx context.Context, h http.Header) {
+	span := SpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+	h.Set(traceparentHeader, span.sc.traceparent())
+	if span.sc.TraceState != "" {
+		h.Set(tracestateHeader, span.sc.TraceState)
+	} else {
+		h.Del(tracestateHeader)
+	}
+}
+
+// SpanFromContext returns the current span, or nil when tracing is off
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// parent returns the context of the current span, falling back to the one extracted from a request
+func parent(ctx context.Context) (SpanContext, bool) {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.sc, true
+	}
+	sc, ok := ctx.Value(remoteKey{}).(SpanContext)
+	return sc, ok
+}
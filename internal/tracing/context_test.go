@@ -0,0 +1,76 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		valid   bool
+		sampled bool
+	}{
+		{"sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"future version with more fields", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"version 00 with more fields", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"invalid version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"zero trace ID", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"zero span ID", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"uppercase", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01", false, false},
+		{"too short", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false, false},
+		{"empty", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := parseTraceparent(tt.header)
+			if ok != tt.valid {
+				t.Fatalf("expected valid to be %v, got %v", tt.valid, ok)
+			}
+			if ok && sc.Sampled != tt.sampled {
+				t.Errorf("expected sampled to be %v, got %v", tt.sampled, sc.Sampled)
+			}
+		})
+	}
+}
+
+func TestExtractAndInject(t *testing.T) {
+	startTracer(t, "http://127.0.0.1:1/v1/traces", 1)
+	in := http.Header{}
+	in.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	in.Set(tracestateHeader, "vendor=opaque")
+
+	ctx, span := Start(Extract(context.Background(), in), "test", KindServer)
+	out := http.Header{}
+	Inject(ctx, out)
+
+	sc, ok := parseTraceparent(out.Get(traceparentHeader))
+	if !ok {
+		t.Fatalf("expected a valid traceparent, got %q", out.Get(traceparentHeader))
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected the trace to continue, got trace ID %s", sc.TraceID)
+	}
+	if sc.SpanID != span.SpanContext().SpanID || span.parentID.String() != "00f067aa0ba902b7" {
+		t.Errorf("expected the injected span to be a child of the extracted one")
+	}
+	if got := out.Get(tracestateHeader); got != "vendor=opaque" {
+		t.Errorf("expected the tracestate to be passed on, got %q", got)
+	}
+}
+
+func TestInjectWithoutTracing(t *testing.T) {
+	h := http.Header{}
+	h.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, span := Start(context.Background(), "test", KindServer)
+	if span != nil {
+		t.Fatal("expected no span while tracing is off")
+	}
+	Inject(ctx, h)
+	if got := h.Get(traceparentHeader); got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("expected the header to be left alone, got %q", got)
+	}
+}
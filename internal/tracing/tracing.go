@@ -0,0 +1,197 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	defaultServiceName   = "jap"
+	defaultSampleRatio   = 1.0
+	defaultFlushInterval = 5 * time.Second
+)
+
+// SpanKind tells what a span stands for, the values are the ones of OTLP
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// current is the tracer that spans are started with, nil while tracing is off
+var current atomic.Pointer[Tracer]
+
+// Tracer starts spans and hands the recorded ones to its exporter
+type Tracer struct {
+	// threshold is compared against the random part of new trace IDs to sample a share of them
+	threshold uint64
+	exporter  *exporter
+}
+
+// Configure replaces the tracer with one for the config, or turns tracing off when it is nil. The spans
+// of the previous tracer are flushed in the background.
+func Configure(cfg *schema.Tracing) error {
+	var t *Tracer
+	if cfg != nil {
+		var err error
+		if t, err = New(*cfg); err != nil {
+			return err
+		}
+	}
+	Use(t)
+	return nil
+}
+
+// Use replaces the tracer spans are started with, nil turns tracing off. The spans of the previous
+// tracer are flushed in the background.
+func Use(t *Tracer) {
+	if old := current.Swap(t); old != nil {
+		go old.exporter.shutdown(context.Background())
+	}
+}
+
+// Shutdown turns tracing off and sends the spans that are still buffered
+func Shutdown(ctx context.Context) error {
+	if old := current.Swap(nil); old != nil {
+		return old.exporter.shutdown(ctx)
+	}
+	return nil
+}
+
+// Shutdown stops the exporter of a tracer, sending the spans that are still buffered
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	return t.exporter.shutdown(ctx)
+}
+
+// New builds a tracer for the config without starting any spans with it yet. A tracer that ends up
+// not being used has to be shut down.
+func New(cfg schema.Tracing) (*Tracer, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("tracing endpoint %q must be an http or https URL", cfg.Endpoint)
+	}
+	ratio := ptr.Deref(cfg.SampleRatio, defaultSampleRatio)
+	if ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("tracing sample ratio must be between 0 and 1, got %v", ratio)
+	}
+	interval := defaultFlushInterval
+	if cfg.FlushInterval != nil {
+		interval = time.Duration(*cfg.FlushInterval)
+	}
+	return &Tracer{
+		threshold: uint64(ratio * (1 << 63)),
+		exporter:  newExporter(endpoint.String(), ptr.Deref(cfg.ServiceName, defaultServiceName), interval),
+	}, nil
+}
+
+// Span is a timed operation within a trace. A nil span does nothing, which is what Start returns
+// while tracing is off, so callers never have to check.
+type Span struct {
+	tracer   *Tracer
+	sc       SpanContext
+	parentID SpanID
+	name     string
+	kind     SpanKind
+	start    time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes []attribute
+	failed     bool
+	message    string
+}
+
+type attribute struct {
+	key   string
+	value any // string or int64
+}
+
+// Start starts a span as a child of the span in the context, or of the span context extracted from a
+// request. Without either a new trace is started, which is sampled by the ratio of the tracer.
+// Children follow the sampling decision of their parent.
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	t := current.Load()
+	if t == nil {
+		return ctx, nil
+	}
+	span := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if p, ok := parent(ctx); ok {
+		span.sc = SpanContext{TraceID: p.TraceID, Sampled: p.Sampled, TraceState: p.TraceState}
+		span.parentID = p.SpanID
+	} else {
+		rand.Read(span.sc.TraceID[:])
+		span.sc.Sampled = binary.BigEndian.Uint64(span.sc.TraceID[8:])>>1 < t.threshold
+	}
+	rand.Read(span.sc.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SpanContext returns the propagated part of the span
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+func (s *Span) SetString(key, value string) {
+	s.set(key, value)
+}
+
+func (s *Span) SetInt(key string, value int) {
+	s.set(key, int64(value))
+}
+
+func (s *Span) set(key string, value any) {
+	if s == nil || !s.sc.Sampled {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes = append(s.attributes, attribute{key, value})
+}
+
+// Fail marks the span as failed
+func (s *Span) Fail(message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed, s.message = true, message
+}
+
+// End finishes the span and queues it for export when it is sampled. Only the first call counts.
+func (s *Span) End() {
+	if s == nil || !s.sc.Sampled {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+	s.tracer.exporter.enqueue(s)
+}
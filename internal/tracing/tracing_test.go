@@ -0,0 +1,126 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxcelant/jap/internal/schema"
+	"k8s.io/utils/ptr"
+)
+
+// startTracer turns tracing on for the test and off again once it is done
+func startTracer(t *testing.T, endpoint string, ratio float64) {
+	t.Helper()
+	interval := schema.Duration(10 * time.Millisecond)
+	if err := Configure(&schema.Tracing{Endpoint: endpoint, SampleRatio: ptr.To(ratio), FlushInterval: &interval}); err != nil {
+		t.Fatalf("failed to configure tracing: %v", err)
+	}
+	t.Cleanup(func() { Shutdown(context.Background()) })
+}
+
+// collector stands in for an OpenTelemetry collector and keeps the spans it receives
+type collector struct {
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+func newCollector(t *testing.T) (*collector, string) {
+	c := &collector{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("collector got an invalid body: %v", err)
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return c, srv.URL + "/v1/traces"
+}
+
+func (c *collector) received() []otlpSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]otlpSpan(nil), c.spans...)
+}
+
+func TestExport(t *testing.T) {
+	c, endpoint := newCollector(t)
+	startTracer(t, endpoint, 1)
+
+	ctx, parent := Start(context.Background(), "parent", KindServer)
+	_, child := Start(ctx, "child", KindClient)
+	child.SetString("server.address", "10.0.0.1:80")
+	child.SetInt("http.response.status_code", 502)
+	child.Fail("Bad Gateway")
+	child.End()
+	parent.End()
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to shut down: %v", err)
+	}
+
+	spans := c.received()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	got := spans[0]
+	if got.Name != "child" || got.Kind != KindClient {
+		t.Errorf("expected the client span first, got %q of kind %d", got.Name, got.Kind)
+	}
+	if got.TraceID != spans[1].TraceID || got.ParentSpanID != spans[1].SpanID {
+		t.Errorf("expected the child to belong to the parent")
+	}
+	if got.Status == nil || got.Status.Code != 2 {
+		t.Errorf("expected an error status, got %+v", got.Status)
+	}
+	if len(got.Attributes) != 2 || *got.Attributes[1].Value.IntValue != "502" {
+		t.Errorf("expected the attributes to be exported, got %+v", got.Attributes)
+	}
+}
+
+func TestSampleRatio(t *testing.T) {
+	tests := []struct {
+		name  string
+		ratio float64
+		min   int
+		max   int
+	}{
+		{"never", 0, 0, 0},
+		{"always", 1, 1000, 1000},
+		{"half", 0.5, 400, 600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			startTracer(t, "http://127.0.0.1:1/v1/traces", tt.ratio)
+			sampled := 0
+			for range 1000 {
+				if _, span := Start(context.Background(), "test", KindServer); span.SpanContext().Sampled {
+					sampled++
+				}
+			}
+			if sampled < tt.min || sampled > tt.max {
+				t.Errorf("expected between %d and %d sampled traces, got %d", tt.min, tt.max, sampled)
+			}
+		})
+	}
+}
+
+func TestParentDecidesSampling(t *testing.T) {
+	startTracer(t, "http://127.0.0.1:1/v1/traces", 0)
+	h := http.Header{}
+	h.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	_, span := Start(Extract(context.Background(), h), "test", KindServer)
+	if !span.SpanContext().Sampled {
+		t.Error("expected a sampled parent to be followed even at a ratio of 0")
+	}
+}